@@ -5,9 +5,11 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"maps"
 	"net/http"
 	"os"
 	"os/signal"
+	"slices"
 	"syscall"
 	"time"
 
@@ -42,6 +44,14 @@ func main() {
 		}
 	}()
 
+	// Load the pipeline config first so a bad ladder file fails before touching the broker.
+	cfg, err := pkg.ConfigFromEnv()
+	if err != nil {
+		log.Fatalf("config: %v", err)
+	}
+	log.Infow("pipeline config", "encodeMode", cfg.EncodeMode, "inputMode", cfg.InputMode, "threadBudget", cfg.ThreadBudget, "threadsPerRendition", cfg.ThreadsPerRendition,
+		"progressRoutingKey", cfg.ProgressRoutingKey, "progressInterval", cfg.ProgressInterval, "gopSeconds", cfg.GOPSeconds, "segmentSeconds", cfg.SegmentSeconds, "ladders", slices.Sorted(maps.Keys(cfg.Ladders)))
+
 	consumer, err := queue.NewConsumerFromEnv(log)
 	if err != nil {
 		log.Fatalf("queue init: %v", err)
@@ -54,21 +64,22 @@ func main() {
 		log.Fatalf("publisher init: %v", err)
 	}
 	defer pub.Close()
+	consumer.OnReconnect(pub.Reconnect)
 
-	az, err := storage.NewAzureClientFromEnv()
+	store, err := storage.NewBackendFromEnv()
 	if err != nil {
-		log.Fatalf("azure: %v", err)
+		log.Fatalf("storage: %v", err)
 	}
 
-	pipeline := pkg.NewTranscoder(log, az, pub)
+	pipeline := pkg.NewTranscoder(log, store, pub, pkg.NewJobStateStoreFromEnv(store), cfg)
 
 	concurrency := queue.GetEnvInt("CONCURRENCY", 1)
 	log.Infof("starting consumer with concurrency=%d", concurrency)
 
-	err = consumer.Consume(ctx, concurrency, func(b []byte) error {
+	err = consumer.Consume(ctx, concurrency, func(ctx context.Context, b []byte) error {
 		var check map[string]any
 		if err := json.Unmarshal(b, &check); err != nil {
-			return fmt.Errorf("invalid json: %w", err)
+			return queue.Permanent(fmt.Errorf("invalid json: %w", err))
 		}
 		log.Infow("upload event", "uploadId", check["uploadId"], "userId", check["userId"])
 		return pipeline.Handle(ctx, b)
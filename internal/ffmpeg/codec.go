@@ -0,0 +1,181 @@
+package ffmpeg
+
+import "fmt"
+
+// Video codec families a ladder can encode, named as ffprobe reports them.
+const (
+	CodecH264 = "h264"
+	CodecHEVC = "hevc"
+	CodecVP9  = "vp9"
+	CodecAV1  = "av1"
+)
+
+// extraCodecs are the optional families in the order their variants are listed, after H.264.
+var extraCodecs = []string{CodecHEVC, CodecVP9, CodecAV1}
+
+// codecEncoders lists the software encoders accepted per family, default first.
+var codecEncoders = map[string][]string{
+	CodecH264: {"libx264"},
+	CodecHEVC: {"libx265"},
+	CodecVP9:  {"libvpx-vp9"},
+	CodecAV1:  {"libsvtav1", "libaom-av1"},
+}
+
+// encoderArgs returns the encoder selection and its speed, profile and level flags for
+// output video stream spec (":v" or ":v:<idx>"). pass and passlog are only used by
+// libx265, which takes its two-pass settings through -x265-params.
+func (r Rung) encoderArgs(spec string, pass int, passlog string) []string {
+	args := []string{"-c" + spec, r.encoder()}
+	switch r.encoder() {
+	case "libx264":
+		args = append(args, "-preset"+spec, "veryfast", "-profile"+spec, r.Profile, "-level"+spec, r.Level)
+	case "libx265":
+		// hvc1 is the sample entry Apple players require for HEVC in fMP4.
+		params := "scenecut=0:open-gop=0"
+		if r.Level != "" {
+			params += ":level-idc=" + r.Level
+		}
+		if pass > 0 {
+			params += fmt.Sprintf(":pass=%d:stats=%s.log", pass, passlog)
+		}
+		args = append(args, "-preset"+spec, "veryfast", "-tag"+spec, "hvc1", "-x265-params"+spec, params)
+		if r.Profile != "" {
+			args = append(args, "-profile"+spec, r.Profile)
+		}
+	case "libvpx-vp9":
+		args = append(args, "-deadline"+spec, "good", "-cpu-used"+spec, "4", "-row-mt"+spec, "1")
+	case "libsvtav1":
+		args = append(args, "-preset"+spec, "8")
+	case "libaom-av1":
+		args = append(args, "-cpu-used"+spec, "6", "-row-mt"+spec, "1")
+	}
+	return args
+}
+
+// VideoCodecString returns the RFC 6381 codec string of the probed video stream, as used
+// in the HLS CODECS and DASH codecs attributes.
+func VideoCodecString(p *ProbeResult) string {
+	switch p.VideoCodec {
+	case CodecH264:
+		pc, ok := avcProfiles[p.VideoProfile]
+		if !ok {
+			pc = avcProfiles["High"]
+		}
+		return fmt.Sprintf("avc1.%02X%02X%02X", pc[0], pc[1], p.VideoLevel)
+	case CodecHEVC:
+		// Main tier; the constraint byte flags progressive, frame-only content.
+		idc, compat := 1, 6
+		if p.VideoProfile == "Main 10" {
+			idc, compat = 2, 4
+		}
+		return fmt.Sprintf("hvc1.%d.%d.L%d.B0", idc, compat, p.VideoLevel)
+	case CodecVP9:
+		level := p.VideoLevel
+		if level <= 0 {
+			level = vp9Level(p.Width*p.Height, p.FrameRate)
+		}
+		return fmt.Sprintf("vp09.00.%02d.08", level)
+	case CodecAV1:
+		level := p.VideoLevel
+		if level <= 0 {
+			level = av1Level(p.Width*p.Height, p.FrameRate)
+		}
+		return fmt.Sprintf("av01.0.%02dM.08", level)
+	default:
+		return p.VideoCodec
+	}
+}
+
+// AudioCodecString returns the RFC 6381 codec string of the probed audio stream.
+func AudioCodecString(p *ProbeResult) string {
+	switch {
+	case p.AudioCodec == "aac" && p.AudioProfile == "HE-AAC":
+		return "mp4a.40.5"
+	case p.AudioCodec == "aac":
+		return "mp4a.40.2"
+	case p.AudioCodec == "mp3":
+		return "mp4a.40.34"
+	default:
+		return p.AudioCodec
+	}
+}
+
+// avcProfiles maps ffprobe profile names to profile_idc and constraint flags.
+var avcProfiles = map[string][2]int{
+	"Constrained Baseline": {0x42, 0xE0},
+	"Baseline":             {0x42, 0x00},
+	"Main":                 {0x4D, 0x40},
+	"Extended":             {0x58, 0x00},
+	"High":                 {0x64, 0x00},
+	"High 10":              {0x6E, 0x00},
+}
+
+// codecLevel is one row of a level table: the largest picture and sample rate allowed.
+type codecLevel struct {
+	level      int
+	pictureMax int
+	sampleRate float64
+}
+
+// vp9Levels is the VP9 level table (level 4.1 is written 41).
+var vp9Levels = []codecLevel{
+	{10, 36864, 829440}, {11, 73728, 2764800}, {20, 122880, 4608000}, {21, 245760, 9216000},
+	{30, 552960, 20736000}, {31, 983040, 36864000}, {40, 2228224, 83558400}, {41, 2228224, 160432128},
+	{50, 8912896, 311951360}, {51, 8912896, 588251136}, {52, 8912896, 1176502272},
+	{60, 35651584, 1176502272}, {61, 35651584, 2353004544}, {62, 35651584, 4706009088},
+}
+
+// av1Levels is the AV1 level table by seq_level_idx.
+var av1Levels = []codecLevel{
+	{0, 147456, 4423680}, {1, 278784, 8363520}, {4, 665856, 19975680}, {5, 1065024, 31950720},
+	{8, 2359296, 70778880}, {9, 2359296, 141557760}, {12, 8912896, 267386880}, {13, 8912896, 534773760},
+	{14, 8912896, 1069547520}, {15, 8912896, 1069547520}, {16, 35651584, 1069547520},
+	{17, 35651584, 2139095040}, {18, 35651584, 4278190080},
+}
+
+func vp9Level(picture int, fps float64) int { return lowestLevel(vp9Levels, picture, fps) }
+func av1Level(picture int, fps float64) int { return lowestLevel(av1Levels, picture, fps) }
+
+// lowestLevel returns the first level whose limits fit the picture size and sample rate,
+// used when the encoder did not signal a level.
+func lowestLevel(table []codecLevel, picture int, fps float64) int {
+	for _, l := range table {
+		if picture <= l.pictureMax && float64(picture)*fps <= l.sampleRate {
+			return l.level
+		}
+	}
+	return table[len(table)-1].level
+}
+
+func validEncoder(codec, encoder string) bool {
+	for _, e := range codecEncoders[codec] {
+		if e == encoder {
+			return true
+		}
+	}
+	return false
+}
+
+// VideoCodec returns the rung's codec family, CodecH264 unless set.
+func (r Rung) VideoCodec() string {
+	if r.Codec == "" {
+		return CodecH264
+	}
+	return r.Codec
+}
+
+func (r Rung) encoder() string {
+	if r.Encoder == "" {
+		return codecEncoders[r.VideoCodec()][0]
+	}
+	return r.Encoder
+}
+
+// ID identifies the rendition: its output directory, variant and checkpoint name. H.264
+// rungs use their name; other families add the codec, e.g. "720p-hevc".
+func (r Rung) ID() string {
+	if r.VideoCodec() == CodecH264 {
+		return r.Name
+	}
+	return r.Name + "-" + r.VideoCodec()
+}
@@ -0,0 +1,51 @@
+package ffmpeg
+
+import (
+	"fmt"
+	"sync"
+)
+
+// CommandError is returned when ffmpeg or ffprobe exits unsuccessfully. Stderr holds the
+// tail of the process output, which is where ffmpeg explains what went wrong.
+type CommandError struct {
+	Err    error
+	Stderr string
+}
+
+func (e *CommandError) Error() string {
+	if e.Stderr == "" {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%v: %s", e.Err, e.Stderr)
+}
+
+func (e *CommandError) Unwrap() error { return e.Err }
+
+// TailBuffer is an io.Writer that keeps only the last Max bytes written to it.
+type TailBuffer struct {
+	Max int
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+// NewTailBuffer returns a TailBuffer holding at most max bytes.
+func NewTailBuffer(max int) *TailBuffer {
+	return &TailBuffer{Max: max}
+}
+
+func (t *TailBuffer) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.buf = append(t.buf, p...)
+	if over := len(t.buf) - t.Max; over > 0 {
+		t.buf = append(t.buf[:0], t.buf[over:]...)
+	}
+	return len(p), nil
+}
+
+func (t *TailBuffer) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return string(t.buf)
+}
@@ -3,34 +3,218 @@ package ffmpeg
 import (
 	"context"
 	"fmt"
+	"math"
 	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
 )
 
-// Variant preset for HLS ladder
-var Presets = map[string][]string{
-	"1080p": {"-vf", "scale=-2:1080", "-b:v", "5000k", "-maxrate", "5350k", "-bufsize", "7500k", "-b:a", "192k"},
-	"720p":  {"-vf", "scale=-2:720", "-b:v", "2800k", "-maxrate", "2996k", "-bufsize", "4200k", "-b:a", "128k"},
-	"480p":  {"-vf", "scale=-2:480", "-b:v", "1400k", "-maxrate", "1498k", "-bufsize", "2100k", "-b:a", "96k"},
-	"360p":  {"-vf", "scale=-2:360", "-b:v", "800k", "-maxrate", "856k", "-bufsize", "1200k", "-b:a", "64k"},
+// EncodeOptions carries the source properties and resources an encode command depends on.
+type EncodeOptions struct {
+	Threads  int  // ffmpeg -threads, 0 leaves the choice to ffmpeg
+	HasAudio bool // the source has an audio stream to map
+	// Portrait is true when the displayed (rotation applied) source is taller than wide.
+	Portrait bool
+	// FrameRate is the output frame rate, see ProbeResult.OutputFrameRate. ConstantFrameRate
+	// makes ffmpeg duplicate/drop frames to hit it exactly, for variable frame rate sources.
+	FrameRate         float64
+	ConstantFrameRate bool
+	// GOPSeconds is the keyframe interval and SegmentSeconds the HLS segment target; the
+	// segment length should be a multiple of the GOP.
+	GOPSeconds     float64
+	SegmentSeconds int
+	// SegmentType is SegmentMPEGTS (the default when empty) or SegmentFMP4.
+	SegmentType string
+	// PassLogFile is the stats file prefix of a RateTwoPass rung, shared by
+	// BuildFirstPassCommand and BuildHLSCommand.
+	PassLogFile string
+	// SeparateAudio leaves audio out of the video variants; it is written once as the
+	// AudioRendition instead, as DASH expects.
+	SeparateAudio bool
 }
 
-func BuildHLSCommand(ctx context.Context, input, outDir string, res string) *exec.Cmd {
+// AudioRendition is the directory and rendition ID of the audio-only variant written
+// when EncodeOptions.SeparateAudio is set.
+const AudioRendition = "audio"
+
+// scaleFilter returns the scale expression for a rung. The rung height applies to the
+// short side, so a portrait 1080p rendition is 1080 pixels wide. ffmpeg autorotates the
+// input before filtering, so portrait is judged on the displayed frame.
+func (r Rung) scaleFilter(portrait bool) string {
+	if portrait {
+		return fmt.Sprintf("scale=%d:-2", r.Height)
+	}
+	return fmt.Sprintf("scale=-2:%d", r.Height)
+}
+
+// videoArgs returns the encoder, its options and the rate control flags of a rung. When
+// idx >= 0 the flags are scoped to that output video stream (e.g. -b:v:1) for
+// multi-output commands. pass is 1 or 2 for the passes of a two-pass encode, else 0.
+func (r Rung) videoArgs(idx, pass int, passlog string) []string {
+	spec := ":v"
+	if idx >= 0 {
+		spec = fmt.Sprintf(":v:%d", idx)
+	}
+	return append(r.encoderArgs(spec, pass, passlog), r.rateArgs(spec, pass, passlog)...)
+}
+
+// gopArgs are shared by every encode so keyframes line up across renditions. The GOP size
+// follows the frame rate, and keyframes are also forced on the GOP time grid so every
+// segment boundary starts with one regardless of frame timing.
+func gopArgs(opts EncodeOptions) []string {
+	fps := opts.FrameRate
+	if fps <= 0 {
+		fps = 30
+	}
+	gop := max(int(math.Round(fps*opts.GOPSeconds)), 1)
 	args := []string{
-		"-y",
-		"-i", input,
-		"-preset", "veryfast",
-		"-g", "48", "-keyint_min", "48", "-sc_threshold", "0",
-		"-c:a", "aac", "-ar", "48000",
-	}
-	args = append(args, Presets[res]...)
-	args = append(args, []string{
-		"-hls_time", "6",
+		"-g", strconv.Itoa(gop), "-keyint_min", strconv.Itoa(gop), "-sc_threshold", "0",
+		"-force_key_frames", fmt.Sprintf("expr:gte(t,n_forced*%s)", strconv.FormatFloat(opts.GOPSeconds, 'f', -1, 64)),
+	}
+	if opts.ConstantFrameRate && opts.FrameRate > 0 {
+		args = append(args, "-fps_mode", "cfr", "-r", rateString(opts.FrameRate))
+	}
+	return args
+}
+
+// rateString formats a frame rate for -r, keeping NTSC rates such as 30000/1001 exact.
+func rateString(fps float64) string {
+	if n := math.Round(fps * 1.001); math.Abs(fps-math.Round(fps)) > 1e-3 && math.Abs(fps-n*1000/1001) < 1e-3 {
+		return fmt.Sprintf("%d/1001", int(n*1000))
+	}
+	return strconv.FormatFloat(fps, 'f', -1, 64)
+}
+
+func hlsArgs(opts EncodeOptions) []string {
+	return []string{
+		"-hls_time", strconv.Itoa(opts.SegmentSeconds),
 		"-hls_playlist_type", "vod",
-		"-hls_segment_type", "mpegts",
+		"-hls_segment_type", opts.segmentType(),
 		"-hls_flags", "independent_segments",
 		"-f", "hls",
-		fmt.Sprintf("%s/index.m3u8", outDir),
-	}...)
+	}
+}
+
+// rotationArgs clear any rotation tag on the output video; autorotation has already
+// applied it to the pixels.
+func rotationArgs() []string {
+	return []string{"-metadata:s:v", "rotate=0"}
+}
+
+// threadArgs caps ffmpeg's worker threads; zero leaves the choice to ffmpeg.
+func threadArgs(threads int) []string {
+	if threads <= 0 {
+		return nil
+	}
+	return []string{"-threads", strconv.Itoa(threads)}
+}
+
+// inputArgs returns the -i arguments for input. For HTTP sources, such as the range proxy
+// of the stream input mode, ffmpeg treats a failed read as end of file and exits cleanly
+// with truncated output, so it is told to reconnect and resume from the same offset.
+func inputArgs(input string) []string {
+	if strings.HasPrefix(input, "http://") || strings.HasPrefix(input, "https://") {
+		return []string{"-reconnect", "1", "-reconnect_on_network_error", "1", "-reconnect_delay_max", "5", "-i", input}
+	}
+	return []string{"-i", input}
+}
+
+func BuildHLSCommand(ctx context.Context, input, outDir string, r Rung, opts EncodeOptions) *exec.Cmd {
+	args := append([]string{"-y"}, inputArgs(input)...)
+	args = append(args, progressArgs()...)
+	args = append(args, threadArgs(opts.Threads)...)
+	args = append(args, gopArgs(opts)...)
+	if opts.SeparateAudio {
+		args = append(args, "-an")
+	} else {
+		args = append(args, "-c:a", "aac", "-ar", "48000", "-b:a", fmt.Sprintf("%dk", r.AudioBitrate))
+	}
+	args = append(args, "-vf", r.scaleFilter(opts.Portrait))
+	args = append(args, rotationArgs()...)
+	args = append(args, r.videoArgs(-1, r.secondPass(), opts.PassLogFile)...)
+	args = append(args, hlsArgs(opts)...)
+	if opts.segmentType() == SegmentFMP4 {
+		args = append(args, "-hls_fmp4_init_filename", InitSegment)
+	}
+	args = append(args, "-hls_segment_filename", filepath.Join(outDir, "index%d"+opts.segmentExt()))
+	args = append(args, fmt.Sprintf("%s/index.m3u8", outDir))
+	return exec.CommandContext(ctx, "ffmpeg", args...)
+}
+
+// BuildHLSAudioCommand writes the audio of input as an audio-only HLS variant in outDir,
+// the AudioRendition of jobs with EncodeOptions.SeparateAudio.
+func BuildHLSAudioCommand(ctx context.Context, input, outDir string, kbps int, opts EncodeOptions) *exec.Cmd {
+	args := append([]string{"-y"}, inputArgs(input)...)
+	args = append(args, progressArgs()...)
+	args = append(args, threadArgs(opts.Threads)...)
+	args = append(args, "-map", "0:a:0", "-vn", "-c:a", "aac", "-ar", "48000", "-b:a", fmt.Sprintf("%dk", kbps))
+	args = append(args, hlsArgs(opts)...)
+	if opts.segmentType() == SegmentFMP4 {
+		args = append(args, "-hls_fmp4_init_filename", InitSegment)
+	}
+	args = append(args, "-hls_segment_filename", filepath.Join(outDir, "index%d"+opts.segmentExt()))
+	args = append(args, filepath.Join(outDir, "index.m3u8"))
+	return exec.CommandContext(ctx, "ffmpeg", args...)
+}
+
+// BuildHLSLadderCommand decodes input once, splits the video into one scaled branch per
+// rung and writes every variant in a single ffmpeg process. Two-pass rungs need
+// per-rendition commands; here they fall back to single-pass bitrate control. Each variant lands in
+// outRoot/<rung ID>/index.m3u8, the same layout BuildHLSCommand produces once
+// FinishLadder has run. With opts.SeparateAudio the video variants carry no audio, and
+// audioKbps > 0 adds the AudioRendition to the same process. ladder must not be empty.
+func BuildHLSLadderCommand(ctx context.Context, input, outRoot string, ladder []Rung, audioKbps int, opts EncodeOptions) *exec.Cmd {
+	var filter strings.Builder
+	fmt.Fprintf(&filter, "[0:v]split=%d", len(ladder))
+	for i := range ladder {
+		fmt.Fprintf(&filter, "[v%d]", i)
+	}
+	for i, r := range ladder {
+		fmt.Fprintf(&filter, ";[v%d]%s[v%dout]", i, r.scaleFilter(opts.Portrait), i)
+	}
+
+	args := append([]string{"-y"}, inputArgs(input)...)
+	args = append(args, "-filter_complex", filter.String())
+	args = append(args, progressArgs()...)
+	streamMap := make([]string, 0, len(ladder))
+	for i, r := range ladder {
+		args = append(args, "-map", fmt.Sprintf("[v%dout]", i))
+		args = append(args, r.videoArgs(i, 0, "")...)
+		if opts.HasAudio && !opts.SeparateAudio {
+			args = append(args, "-map", "0:a:0", fmt.Sprintf("-c:a:%d", i), "aac", fmt.Sprintf("-b:a:%d", i), fmt.Sprintf("%dk", r.AudioBitrate))
+			streamMap = append(streamMap, fmt.Sprintf("v:%d,a:%d,name:%s", i, i, r.ID()))
+		} else {
+			streamMap = append(streamMap, fmt.Sprintf("v:%d,name:%s", i, r.ID()))
+		}
+	}
+	withAudio := opts.HasAudio && !opts.SeparateAudio
+	if opts.HasAudio && opts.SeparateAudio && audioKbps > 0 {
+		args = append(args, "-map", "0:a:0", "-c:a:0", "aac", "-b:a:0", fmt.Sprintf("%dk", audioKbps))
+		streamMap = append(streamMap, "a:0,name:"+AudioRendition)
+		withAudio = true
+	}
+	args = append(args, gopArgs(opts)...)
+	args = append(args, rotationArgs()...)
+	args = append(args, threadArgs(opts.Threads)...)
+	if withAudio {
+		args = append(args, "-ar", "48000")
+	}
+	args = append(args, hlsArgs(opts)...)
+	if opts.segmentType() == SegmentFMP4 {
+		// ffmpeg only expands %v in the init file name when there are several variants;
+		// with several, init files are named per variant and fixed up by FinishLadder.
+		init := ladderInitPattern
+		if len(streamMap) == 1 {
+			init = InitSegment
+		}
+		args = append(args, "-hls_fmp4_init_filename", init)
+	}
+	args = append(args,
+		"-hls_segment_filename", filepath.Join(outRoot, "%v", "index%d"+opts.segmentExt()),
+		"-var_stream_map", strings.Join(streamMap, " "),
+		filepath.Join(outRoot, "%v", "index.m3u8"),
+	)
 	return exec.CommandContext(ctx, "ffmpeg", args...)
 }
 
@@ -0,0 +1,263 @@
+package ffmpeg
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"regexp"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultLadderName is the ladder used when a job does not ask for one.
+const DefaultLadderName = "default"
+
+// Rung is one rendition of an encoding ladder. Bitrates are in kbit/s.
+type Rung struct {
+	Name         string `yaml:"name"`
+	Height       int    `yaml:"height"`
+	VideoBitrate int    `yaml:"videoBitrate"`
+	MaxRate      int    `yaml:"maxrate"`
+	BufSize      int    `yaml:"bufsize"`
+	AudioBitrate int    `yaml:"audioBitrate"`
+	// Profile and Level are required for H.264 (baseline|main|high, e.g. "4.1"), optional
+	// for HEVC (main) and unused for VP9 and AV1.
+	Profile string `yaml:"profile"`
+	Level   string `yaml:"level"`
+	// RateControl is RateCBR (default), RateCRF or RateTwoPass. CRF is the quality
+	// target in crf mode; maxrate/bufsize cap every mode.
+	RateControl string `yaml:"rateControl"`
+	CRF         int    `yaml:"crf"`
+
+	// Codec and Encoder are filled from the family the rung is listed under, see Ladder.All.
+	Codec   string `yaml:"-"`
+	Encoder string `yaml:"-"`
+}
+
+// Bandwidth is the nominal peak bitrate of the rendition in bit/s, video plus audio.
+func (r Rung) Bandwidth() int {
+	return (r.MaxRate + r.AudioBitrate) * 1000
+}
+
+// Resolution is the nominal 16:9 (or 9:16 when portrait) frame size for the rung.
+func (r Rung) Resolution(portrait bool) string {
+	long := int(math.Round(float64(r.Height) * 16 / 9))
+	if long%2 != 0 {
+		long++
+	}
+	if portrait {
+		return fmt.Sprintf("%dx%d", r.Height, long)
+	}
+	return fmt.Sprintf("%dx%d", long, r.Height)
+}
+
+// Ladder is an ordered list of rungs, largest first.
+type Ladder struct {
+	// SegmentType is the default HLS segment container for jobs using this ladder,
+	// SegmentMPEGTS when empty.
+	SegmentType string `yaml:"segmentType"`
+	// DASH writes a DASH manifest next to the HLS master; it forces SegmentFMP4.
+	DASH bool `yaml:"dash"`
+	// PerTitle adapts the rung bitrates to the source's complexity before encoding.
+	PerTitle bool `yaml:"perTitle"`
+	// Rungs are the H.264 renditions, always encoded so every player has a fallback.
+	Rungs []Rung `yaml:"rungs"`
+	// Codecs adds optional families (hevc, vp9, av1) with their own bitrate tables. They
+	// are only delivered as fMP4.
+	Codecs map[string]CodecLadder `yaml:"codecs"`
+}
+
+// CodecLadder is the rung table of one extra codec family.
+type CodecLadder struct {
+	// Encoder picks the ffmpeg encoder; empty selects the family default (libx265,
+	// libvpx-vp9, libsvtav1). AV1 also accepts libaom-av1.
+	Encoder string `yaml:"encoder"`
+	Rungs   []Rung `yaml:"rungs"`
+}
+
+// All returns every rendition of the ladder, H.264 first and then each extra family in a
+// fixed order, with Codec and Encoder set.
+func (l Ladder) All() []Rung {
+	all := make([]Rung, 0, len(l.Rungs))
+	for _, r := range l.Rungs {
+		r.Codec = CodecH264
+		all = append(all, r)
+	}
+	for _, codec := range extraCodecs {
+		cl, ok := l.Codecs[codec]
+		if !ok {
+			continue
+		}
+		for _, r := range cl.Rungs {
+			r.Codec, r.Encoder = codec, cl.Encoder
+			all = append(all, r)
+		}
+	}
+	return all
+}
+
+// HasExtraCodecs reports whether the ladder encodes families besides H.264.
+func (l Ladder) HasExtraCodecs() bool {
+	return len(l.Codecs) > 0
+}
+
+// Rung returns the rung called name.
+func (l Ladder) Rung(name string) (Rung, bool) {
+	for _, r := range l.Rungs {
+		if r.Name == name {
+			return r, true
+		}
+	}
+	return Rung{}, false
+}
+
+// LadderSet holds the named ladders available to jobs.
+type LadderSet map[string]Ladder
+
+// DefaultLadders is used when no ladder file is configured.
+var DefaultLadders = LadderSet{
+	DefaultLadderName: {Rungs: []Rung{
+		{Name: "1080p", Height: 1080, VideoBitrate: 5000, MaxRate: 5350, BufSize: 7500, AudioBitrate: 192, Profile: "high", Level: "4.1"},
+		{Name: "720p", Height: 720, VideoBitrate: 2800, MaxRate: 2996, BufSize: 4200, AudioBitrate: 128, Profile: "high", Level: "3.1"},
+		{Name: "480p", Height: 480, VideoBitrate: 1400, MaxRate: 1498, BufSize: 2100, AudioBitrate: 96, Profile: "main", Level: "3.1"},
+		{Name: "360p", Height: 360, VideoBitrate: 800, MaxRate: 856, BufSize: 1200, AudioBitrate: 64, Profile: "main", Level: "3.0"},
+	}},
+}
+
+type ladderFile struct {
+	Ladders LadderSet `yaml:"ladders"`
+}
+
+// LoadLadders reads and validates a YAML or JSON ladder file of the form
+//
+//	ladders:
+//	  default:
+//	    rungs:
+//	      - {name: 720p, height: 720, videoBitrate: 2800, maxrate: 2996, bufsize: 4200, audioBitrate: 128, profile: high, level: "3.1"}
+func LoadLadders(path string) (LadderSet, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	// Unknown keys are errors, so a misspelled option fails at startup instead of
+	// silently falling back to its default.
+	var f ladderFile
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(&f); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("ladder file %s: %w", path, err)
+	}
+	if err := f.Ladders.Validate(); err != nil {
+		return nil, fmt.Errorf("ladder file %s: %w", path, err)
+	}
+	return f.Ladders, nil
+}
+
+var (
+	rungNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]*$`)
+	levelPattern    = regexp.MustCompile(`^[1-6](\.[0-2])?$`)
+	h264Profiles    = map[string]bool{"baseline": true, "main": true, "high": true}
+)
+
+// Validate checks every ladder for values ffmpeg and the master playlist rely on.
+func (s LadderSet) Validate() error {
+	if _, ok := s[DefaultLadderName]; !ok {
+		return fmt.Errorf("a %q ladder is required", DefaultLadderName)
+	}
+	for name, l := range s {
+		if len(l.Rungs) == 0 {
+			return fmt.Errorf("ladder %q has no rungs", name)
+		}
+		if l.SegmentType != "" && !ValidSegmentType(l.SegmentType) {
+			return fmt.Errorf("ladder %q: unknown segmentType %q", name, l.SegmentType)
+		}
+		if (l.DASH || l.HasExtraCodecs()) && l.SegmentType == SegmentMPEGTS {
+			return fmt.Errorf("ladder %q: dash and extra codecs require segmentType fmp4", name)
+		}
+		for codec, cl := range l.Codecs {
+			if codec == CodecH264 || codecEncoders[codec] == nil {
+				return fmt.Errorf("ladder %q: unknown codec family %q", name, codec)
+			}
+			if len(cl.Rungs) == 0 {
+				return fmt.Errorf("ladder %q: codec %q has no rungs", name, codec)
+			}
+			if cl.Encoder != "" && !validEncoder(codec, cl.Encoder) {
+				return fmt.Errorf("ladder %q: encoder %q cannot encode %s", name, cl.Encoder, codec)
+			}
+		}
+		seen := map[string]bool{}
+		for i, r := range l.All() {
+			if err := r.validate(); err != nil {
+				return fmt.Errorf("ladder %q rung %d: %w", name, i, err)
+			}
+			if seen[r.ID()] {
+				return fmt.Errorf("ladder %q: duplicate rung %q", name, r.ID())
+			}
+			seen[r.ID()] = true
+		}
+	}
+	return nil
+}
+
+func (r Rung) validate() error {
+	if err := r.validateRates(); err != nil {
+		return err
+	}
+	switch r.VideoCodec() {
+	case CodecH264:
+		if !h264Profiles[r.Profile] {
+			return fmt.Errorf("%s: unknown profile %q", r.ID(), r.Profile)
+		}
+		if !levelPattern.MatchString(r.Level) {
+			return fmt.Errorf("%s: invalid level %q", r.ID(), r.Level)
+		}
+	case CodecHEVC:
+		if r.Profile != "" && r.Profile != "main" {
+			return fmt.Errorf("%s: unsupported hevc profile %q", r.ID(), r.Profile)
+		}
+		if r.Level != "" && !levelPattern.MatchString(r.Level) {
+			return fmt.Errorf("%s: invalid level %q", r.ID(), r.Level)
+		}
+	default:
+		if r.Profile != "" || r.Level != "" {
+			return fmt.Errorf("%s: profile and level are not supported for %s", r.ID(), r.VideoCodec())
+		}
+	}
+	return nil
+}
+
+func (r Rung) validateRates() error {
+	switch r.rateControl() {
+	case RateCBR:
+	case RateCRF:
+		maxCRF := 63
+		if r.VideoCodec() == CodecH264 || r.VideoCodec() == CodecHEVC {
+			maxCRF = 51
+		}
+		if r.CRF < 1 || r.CRF > maxCRF {
+			return fmt.Errorf("%s: crf must be between 1 and %d", r.ID(), maxCRF)
+		}
+	case RateTwoPass:
+		if r.encoder() == "libsvtav1" {
+			return fmt.Errorf("%s: two-pass is not supported with libsvtav1", r.ID())
+		}
+	default:
+		return fmt.Errorf("%s: unknown rateControl %q", r.ID(), r.RateControl)
+	}
+	switch {
+	case !rungNamePattern.MatchString(r.Name):
+		return fmt.Errorf("invalid name %q", r.Name)
+	case r.Height <= 0 || r.Height%2 != 0:
+		return fmt.Errorf("%s: height must be a positive even number", r.Name)
+	case r.VideoBitrate <= 0 || r.AudioBitrate <= 0:
+		return fmt.Errorf("%s: bitrates must be positive", r.Name)
+	case r.MaxRate < r.VideoBitrate:
+		return fmt.Errorf("%s: maxrate must be at least videoBitrate", r.Name)
+	case r.BufSize <= 0:
+		return fmt.Errorf("%s: bufsize must be positive", r.Name)
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package ffmpeg
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadLaddersExample(t *testing.T) {
+	ladders, err := LoadLadders(filepath.Join("..", "..", "config", "ladders.example.yaml"))
+	if err != nil {
+		t.Fatalf("load example ladders: %v", err)
+	}
+	for _, name := range []string{DefaultLadderName, "mobile-first", "premium"} {
+		if _, ok := ladders[name]; !ok {
+			t.Errorf("ladder %q missing from example file", name)
+		}
+	}
+}
+
+func TestLoadLaddersRejectsUnknownKeys(t *testing.T) {
+	tests := map[string]string{
+		"rung key": `ladders:
+  default:
+    rungs:
+      - {name: 720p, height: 720, videoBitrate: 2800, maxrate: 2996, bufsize: 4200, audioBitrate: 128, ratecontrol: crf}
+`,
+		"ladder key": `ladders:
+  default:
+    segmenttype: fmp4
+    rungs:
+      - {name: 720p, height: 720, videoBitrate: 2800, maxrate: 2996, bufsize: 4200, audioBitrate: 128}
+`,
+	}
+	for name, doc := range tests {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "ladders.yaml")
+			if err := os.WriteFile(path, []byte(doc), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			_, err := LoadLadders(path)
+			if err == nil || !strings.Contains(err.Error(), "not found") {
+				t.Fatalf("expected an unknown field error, got %v", err)
+			}
+		})
+	}
+}
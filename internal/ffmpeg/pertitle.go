@@ -0,0 +1,159 @@
+package ffmpeg
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// referenceHeight is the rung height per-title test encodes aim for.
+const referenceHeight = 720
+
+// pixelExponent models how the bitrate needed for a given quality grows with the pixel
+// count: roughly pixels^0.75, i.e. height^1.5 at a fixed aspect ratio.
+const pixelExponent = 0.75
+
+// Complexity is the outcome of a per-title analysis of one source.
+type Complexity struct {
+	// Score is the bitrate the test encodes needed at the test CRF, relative to the
+	// reference rung's videoBitrate: about 1 for typical content, lower for simple content.
+	Score float64 `json:"score"`
+	// Scale is Score clamped to the configured bounds and applied to the ladder bitrates.
+	Scale      float64 `json:"scale"`
+	SampleKbps float64 `json:"sampleKbps"`
+	TestHeight int     `json:"testHeight"`
+}
+
+// AnalysisOptions controls the per-title test encodes.
+type AnalysisOptions struct {
+	Samples       int     // number of segments sampled across the source
+	SampleSeconds float64 // length of each sample
+	CRF           int     // x264 CRF of the test encodes
+	// MinScale and MaxScale bound the factor applied to the ladder bitrates.
+	MinScale, MaxScale float64
+	Threads            int
+	Portrait           bool
+}
+
+// ReferenceRung returns the H.264 rung test encodes are measured against: the one
+// closest to 720 lines.
+func ReferenceRung(ladder []Rung) (Rung, bool) {
+	best, found := Rung{}, false
+	for _, r := range ladder {
+		if r.VideoCodec() != CodecH264 {
+			continue
+		}
+		if !found || math.Abs(float64(r.Height-referenceHeight)) < math.Abs(float64(best.Height-referenceHeight)) {
+			best, found = r, true
+		}
+	}
+	return best, found
+}
+
+// AnalyzeComplexity runs fast CRF encodes of evenly spaced samples of input at the
+// reference rung's resolution and compares their bitrate with the rung's budget. Sample
+// files are written to workDir and removed afterwards.
+func AnalyzeComplexity(ctx context.Context, input, workDir string, duration float64, ref Rung, opts AnalysisOptions) (*Complexity, error) {
+	if duration <= 0 {
+		return nil, fmt.Errorf("per-title analysis needs the source duration")
+	}
+	var totalBytes int64
+	var totalSec float64
+	for i, start := range samplePoints(duration, opts.Samples, opts.SampleSeconds) {
+		length := math.Min(opts.SampleSeconds, duration-start)
+		out := filepath.Join(workDir, fmt.Sprintf("sample-%d.h264", i))
+		cmd := buildSampleCommand(ctx, input, out, start, length, ref, opts)
+		tail := NewTailBuffer(4096)
+		cmd.Stderr = tail
+		err := cmd.Run()
+		if err != nil {
+			os.Remove(out)
+			return nil, &CommandError{Err: fmt.Errorf("sample %d: %w", i, err), Stderr: tail.String()}
+		}
+		fi, err := os.Stat(out)
+		os.Remove(out)
+		if err != nil {
+			return nil, err
+		}
+		totalBytes += fi.Size()
+		totalSec += length
+	}
+	c := &Complexity{TestHeight: ref.Height}
+	c.SampleKbps = float64(totalBytes*8) / totalSec / 1000
+	c.Score = c.SampleKbps / float64(ref.VideoBitrate)
+	c.Scale = math.Min(math.Max(c.Score, opts.MinScale), opts.MaxScale)
+	return c, nil
+}
+
+// samplePoints spreads n sample start times over the source, away from its very start
+// and end. Short sources are sampled once from the start.
+func samplePoints(duration float64, n int, length float64) []float64 {
+	if n < 1 || duration <= float64(n)*length {
+		return []float64{0}
+	}
+	points := make([]float64, n)
+	for i := range points {
+		points[i] = math.Max(0, duration*float64(i+1)/float64(n+1)-length/2)
+	}
+	return points
+}
+
+func buildSampleCommand(ctx context.Context, input, out string, start, length float64, ref Rung, opts AnalysisOptions) *exec.Cmd {
+	args := []string{"-y", "-ss", strconv.FormatFloat(start, 'f', 3, 64), "-i", input,
+		"-t", strconv.FormatFloat(length, 'f', 3, 64), "-an", "-sn"}
+	args = append(args, threadArgs(opts.Threads)...)
+	args = append(args, "-vf", ref.scaleFilter(opts.Portrait),
+		"-c:v", "libx264", "-preset", "veryfast", "-crf", strconv.Itoa(opts.CRF),
+		"-f", "h264", out)
+	return exec.CommandContext(ctx, "ffmpeg", args...)
+}
+
+// ApplyComplexity scales every rung's bitrates by c.Scale and prunes the top of the
+// ladder the content does not need: walking the H.264 rungs upwards, the first rung whose
+// estimated bitrate is no more than the rung below it already gets is dropped together
+// with every rung above it, so the kept ladder has no gaps. Other families lose the
+// rungs of the same name. The lowest H.264 rung is always kept.
+func ApplyComplexity(ladder []Rung, c *Complexity) (kept, pruned []Rung) {
+	scaled := make([]Rung, len(ladder))
+	for i, r := range ladder {
+		r.VideoBitrate = scaleKbps(r.VideoBitrate, c.Scale)
+		r.MaxRate = scaleKbps(r.MaxRate, c.Scale)
+		r.BufSize = scaleKbps(r.BufSize, c.Scale)
+		scaled[i] = r
+	}
+
+	var h264 []Rung
+	for _, r := range scaled {
+		if r.VideoCodec() == CodecH264 {
+			h264 = append(h264, r)
+		}
+	}
+	sort.Slice(h264, func(i, j int) bool { return h264[i].Height < h264[j].Height })
+	drop := map[string]bool{}
+	for i := 1; i < len(h264); i++ {
+		need := c.SampleKbps * math.Pow(float64(h264[i].Height)/float64(c.TestHeight), 2*pixelExponent)
+		if need <= float64(h264[i-1].VideoBitrate) {
+			for _, r := range h264[i:] {
+				drop[r.Name] = true
+			}
+			break
+		}
+	}
+	for _, r := range scaled {
+		if drop[r.Name] {
+			pruned = append(pruned, r)
+		} else {
+			kept = append(kept, r)
+		}
+	}
+	return kept, pruned
+}
+
+func scaleKbps(kbps int, scale float64) int {
+	return max(int(math.Round(float64(kbps)*scale)), 1)
+}
@@ -0,0 +1,285 @@
+package ffmpeg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// ErrNoVideoStream is returned by Probe when the input has no video stream.
+var ErrNoVideoStream = errors.New("no video stream found")
+
+// ProbeResult holds the properties of a media file as reported by ffprobe.
+type ProbeResult struct {
+	Width     int     // coded width of the first video stream
+	Height    int     // coded height of the first video stream
+	FrameRate float64 // average frames per second
+	// VariableFrameRate is set when the average and base (r_frame_rate) rates disagree.
+	VariableFrameRate bool
+	Duration          float64 // seconds, of the container
+	// VideoDuration and AudioDuration are the first video and audio streams' own lengths
+	// in seconds, 0 when the file does not say.
+	VideoDuration float64
+	AudioDuration float64
+	VideoCodec    string
+	AudioCodec    string
+	// VideoProfile and VideoLevel are as reported by ffprobe, e.g. "High" and 41.
+	VideoProfile string
+	VideoLevel   int
+	AudioProfile string // e.g. "LC" for AAC-LC
+	Rotation     int    // clockwise degrees, normalised to 0/90/180/270
+	FormatName   string
+}
+
+// DisplayWidth returns the width after applying rotation.
+func (p *ProbeResult) DisplayWidth() int {
+	if p.Rotation == 90 || p.Rotation == 270 {
+		return p.Height
+	}
+	return p.Width
+}
+
+// DisplayHeight returns the height after applying rotation.
+func (p *ProbeResult) DisplayHeight() int {
+	if p.Rotation == 90 || p.Rotation == 270 {
+		return p.Width
+	}
+	return p.Height
+}
+
+// standardFrameRates are the constant rates variable frame rate sources are snapped to.
+var standardFrameRates = []float64{24000.0 / 1001, 24, 25, 30000.0 / 1001, 30, 50, 60000.0 / 1001, 60}
+
+// OutputFrameRate is the constant frame rate to encode at: the probed rate, or for
+// variable frame rate sources the nearest standard rate. It is 0 when unknown.
+func (p *ProbeResult) OutputFrameRate() float64 {
+	if !p.VariableFrameRate || p.FrameRate <= 0 {
+		return p.FrameRate
+	}
+	best := standardFrameRates[0]
+	for _, r := range standardFrameRates {
+		if math.Abs(r-p.FrameRate) < math.Abs(best-p.FrameRate) {
+			best = r
+		}
+	}
+	return best
+}
+
+// Portrait reports whether the displayed frame is taller than it is wide.
+func (p *ProbeResult) Portrait() bool {
+	return p.DisplayHeight() > p.DisplayWidth()
+}
+
+// ShortSide returns the shorter displayed dimension, which ladder rung heights refer to.
+func (p *ProbeResult) ShortSide() int {
+	return min(p.Width, p.Height)
+}
+
+type probeSideData struct {
+	SideDataType string  `json:"side_data_type"`
+	Rotation     float64 `json:"rotation"`
+}
+
+type probeOutput struct {
+	Streams []struct {
+		CodecType    string            `json:"codec_type"`
+		CodecName    string            `json:"codec_name"`
+		Profile      string            `json:"profile"`
+		Level        int               `json:"level"`
+		Width        int               `json:"width"`
+		Height       int               `json:"height"`
+		RFrameRate   string            `json:"r_frame_rate"`
+		AvgFrameRate string            `json:"avg_frame_rate"`
+		Duration     string            `json:"duration"`
+		Tags         map[string]string `json:"tags"`
+		SideDataList []probeSideData   `json:"side_data_list"`
+	} `json:"streams"`
+	Format struct {
+		FormatName string `json:"format_name"`
+		Duration   string `json:"duration"`
+	} `json:"format"`
+}
+
+// Probe runs ffprobe against input and extracts the first video and audio stream properties.
+func Probe(ctx context.Context, input string) (*ProbeResult, error) {
+	res, err := probeStreams(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	if res.VideoCodec == "" {
+		return nil, ErrNoVideoStream
+	}
+	return res, nil
+}
+
+// probeStreams is Probe without the video stream requirement, for audio-only renditions.
+func probeStreams(ctx context.Context, input string) (*ProbeResult, error) {
+	cmd := exec.CommandContext(ctx, "ffprobe",
+		"-v", "error",
+		"-print_format", "json",
+		"-show_format",
+		"-show_streams",
+		input,
+	)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, &CommandError{Err: fmt.Errorf("ffprobe: %w", err), Stderr: strings.TrimSpace(stderr.String())}
+	}
+	return parseStreams(stdout.Bytes())
+}
+
+func parseStreams(b []byte) (*ProbeResult, error) {
+	var out probeOutput
+	if err := json.Unmarshal(b, &out); err != nil {
+		return nil, fmt.Errorf("ffprobe json: %w", err)
+	}
+	res := &ProbeResult{FormatName: out.Format.FormatName}
+	res.Duration, _ = strconv.ParseFloat(out.Format.Duration, 64)
+
+	videoFound := false
+	for _, s := range out.Streams {
+		switch s.CodecType {
+		case "video":
+			if videoFound {
+				continue
+			}
+			videoFound = true
+			res.VideoCodec, res.VideoProfile, res.VideoLevel = s.CodecName, s.Profile, s.Level
+			res.Width, res.Height = s.Width, s.Height
+			res.FrameRate = parseRate(s.AvgFrameRate)
+			base := parseRate(s.RFrameRate)
+			if res.FrameRate == 0 {
+				res.FrameRate = base
+			}
+			res.VariableFrameRate = base > 0 && math.Abs(base-res.FrameRate)/base > 0.01
+			res.VideoDuration = streamDuration(s.Duration, s.Tags)
+			res.Rotation = streamRotation(s.Tags["rotate"], s.SideDataList)
+		case "audio":
+			if res.AudioCodec == "" {
+				res.AudioCodec, res.AudioProfile = s.CodecName, s.Profile
+				res.AudioDuration = streamDuration(s.Duration, s.Tags)
+			}
+		}
+	}
+	if res.Duration == 0 {
+		// Live recordings often leave the header duration empty; the streams may know.
+		res.Duration = max(res.VideoDuration, res.AudioDuration)
+	}
+	return res, nil
+}
+
+// MeasureDuration reads input to the end with a stream copy and returns how far the video
+// got, in seconds. It is the fallback for sources whose headers state no duration.
+func MeasureDuration(ctx context.Context, input string) (float64, error) {
+	args := append([]string{"-v", "error"}, inputArgs(input)...)
+	args = append(args, progressArgs()...)
+	args = append(args, "-map", "0:v:0", "-c", "copy", "-f", "null", "-")
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	tail := NewTailBuffer(4096)
+	cmd.Stderr = tail
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return 0, err
+	}
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+	var last Progress
+	perr := ParseProgress(stdout, 0, func(p Progress) { last = p })
+	if err := cmd.Wait(); err != nil {
+		return 0, &CommandError{Err: fmt.Errorf("measure duration: %w", err), Stderr: tail.String()}
+	}
+	if perr != nil {
+		return 0, perr
+	}
+	return last.OutTime.Seconds(), nil
+}
+
+// streamDuration returns a stream's length in seconds. Matroska and WebM carry it only
+// as a DURATION tag such as "00:01:02.500000000".
+func streamDuration(duration string, tags map[string]string) float64 {
+	if d, err := strconv.ParseFloat(duration, 64); err == nil && d > 0 {
+		return d
+	}
+	h, rest, ok := strings.Cut(tags["DURATION"], ":")
+	m, sec, ok2 := strings.Cut(rest, ":")
+	if !ok || !ok2 {
+		return 0
+	}
+	hv, err1 := strconv.Atoi(h)
+	mv, err2 := strconv.Atoi(m)
+	sv, err3 := strconv.ParseFloat(sec, 64)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return 0
+	}
+	return float64(hv*3600+mv*60) + sv
+}
+
+// parseRate parses ffprobe rationals such as "30000/1001".
+func parseRate(s string) float64 {
+	num, den, ok := strings.Cut(s, "/")
+	if !ok {
+		f, _ := strconv.ParseFloat(s, 64)
+		return f
+	}
+	n, err1 := strconv.ParseFloat(num, 64)
+	d, err2 := strconv.ParseFloat(den, 64)
+	if err1 != nil || err2 != nil || d == 0 {
+		return 0
+	}
+	return n / d
+}
+
+// streamRotation prefers the legacy rotate tag and falls back to display matrix side data,
+// which ffprobe reports counter-clockwise.
+func streamRotation(tag string, sideData []probeSideData) int {
+	deg := 0.0
+	if tag != "" {
+		deg, _ = strconv.ParseFloat(tag, 64)
+	} else {
+		for _, sd := range sideData {
+			if sd.SideDataType == "Display Matrix" {
+				deg = -sd.Rotation
+				break
+			}
+		}
+	}
+	r := int(math.Round(deg/90)) * 90 % 360
+	if r < 0 {
+		r += 360
+	}
+	return r
+}
+
+// TrimLadder drops rungs that would upscale the source's short side. The smallest H.264
+// rung is always kept, so tiny sources still produce a playable fallback rendition;
+// other codec families may be dropped entirely.
+func TrimLadder(ladder []Rung, p *ProbeResult) (kept, dropped []Rung) {
+	short := p.ShortSide()
+	fits := func(r Rung) bool { return short <= 0 || r.Height <= short }
+	smallest, h264Fits := -1, false
+	for i, r := range ladder {
+		if r.VideoCodec() != CodecH264 {
+			continue
+		}
+		h264Fits = h264Fits || fits(r)
+		if smallest < 0 || r.Height < ladder[smallest].Height {
+			smallest = i
+		}
+	}
+	for i, r := range ladder {
+		if fits(r) || (!h264Fits && i == smallest) {
+			kept = append(kept, r)
+		} else {
+			dropped = append(dropped, r)
+		}
+	}
+	return kept, dropped
+}
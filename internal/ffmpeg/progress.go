@@ -0,0 +1,60 @@
+package ffmpeg
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Progress is one update emitted by ffmpeg's -progress output.
+type Progress struct {
+	OutTime time.Duration
+	FPS     float64
+	Speed   float64 // multiple of realtime, e.g. 2.5 for "2.5x"
+	Percent float64 // 0-100 against the probed duration, 0 when the duration is unknown
+	Done    bool
+}
+
+// progressArgs make ffmpeg write machine readable progress blocks to stdout.
+func progressArgs() []string {
+	return []string{"-progress", "pipe:1", "-nostats"}
+}
+
+// ParseProgress reads the key=value blocks written by -progress and calls fn once per
+// block. duration is the source length in seconds and is used to compute Percent.
+func ParseProgress(r io.Reader, duration float64, fn func(Progress)) error {
+	var p Progress
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		key, val, ok := strings.Cut(strings.TrimSpace(sc.Text()), "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "out_time_us", "out_time_ms": // both are microseconds
+			if us, err := strconv.ParseInt(val, 10, 64); err == nil && us >= 0 {
+				p.OutTime = time.Duration(us) * time.Microsecond
+			}
+		case "fps":
+			p.FPS, _ = strconv.ParseFloat(val, 64)
+		case "speed":
+			p.Speed, _ = strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(val), "x"), 64)
+		case "progress":
+			p.Done = val == "end"
+			p.Percent = 0
+			if duration > 0 {
+				p.Percent = p.OutTime.Seconds() / duration * 100
+				if p.Percent > 100 {
+					p.Percent = 100
+				}
+			}
+			if p.Done {
+				p.Percent = 100
+			}
+			fn(p)
+		}
+	}
+	return sc.Err()
+}
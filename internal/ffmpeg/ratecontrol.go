@@ -0,0 +1,73 @@
+package ffmpeg
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+)
+
+// Rate control modes of a rung.
+const (
+	// RateCBR targets videoBitrate constrained by maxrate/bufsize. It is the default.
+	RateCBR = "cbr"
+	// RateCRF encodes at constant quality (crf), capped by maxrate/bufsize.
+	RateCRF = "crf"
+	// RateTwoPass is two-pass VBR at videoBitrate, capped by maxrate/bufsize.
+	RateTwoPass = "2pass"
+)
+
+func (r Rung) rateControl() string {
+	if r.RateControl == "" {
+		return RateCBR
+	}
+	return r.RateControl
+}
+
+// TwoPass reports whether the rung needs a first analysis pass, which only
+// per-rendition commands can run.
+func (r Rung) TwoPass() bool { return r.rateControl() == RateTwoPass }
+
+// secondPass is the pass number BuildHLSCommand encodes with: 2 for two-pass rungs.
+func (r Rung) secondPass() int {
+	if r.TwoPass() {
+		return 2
+	}
+	return 0
+}
+
+// rateArgs returns the rate control flags for output video stream spec.
+func (r Rung) rateArgs(spec string, pass int, passlog string) []string {
+	caps := []string{
+		"-maxrate" + spec, fmt.Sprintf("%dk", r.MaxRate),
+		"-bufsize" + spec, fmt.Sprintf("%dk", r.BufSize),
+	}
+	if r.rateControl() == RateCRF {
+		args := []string{"-crf" + spec, strconv.Itoa(r.CRF)}
+		switch r.encoder() {
+		case "libvpx-vp9", "libaom-av1":
+			// Constrained quality: -b:v is the cap rather than the target.
+			args = append(args, "-b"+spec, fmt.Sprintf("%dk", r.MaxRate))
+		}
+		return append(args, caps...)
+	}
+	args := append([]string{"-b" + spec, fmt.Sprintf("%dk", r.VideoBitrate)}, caps...)
+	if pass > 0 && r.encoder() != "libx265" {
+		args = append(args, "-pass"+spec, strconv.Itoa(pass), "-passlogfile"+spec, passlog)
+	}
+	return args
+}
+
+// BuildFirstPassCommand runs the analysis pass of a two-pass rung, writing its stats to
+// opts.PassLogFile and discarding the video.
+func BuildFirstPassCommand(ctx context.Context, input string, r Rung, opts EncodeOptions) *exec.Cmd {
+	args := append([]string{"-y"}, inputArgs(input)...)
+	args = append(args, progressArgs()...)
+	args = append(args, threadArgs(opts.Threads)...)
+	args = append(args, gopArgs(opts)...)
+	args = append(args, "-an", "-vf", r.scaleFilter(opts.Portrait))
+	args = append(args, r.videoArgs(-1, 1, opts.PassLogFile)...)
+	args = append(args, "-f", "null", os.DevNull)
+	return exec.CommandContext(ctx, "ffmpeg", args...)
+}
@@ -0,0 +1,80 @@
+package ffmpeg
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// HLS segment containers, as accepted by ffmpeg's -hls_segment_type.
+const (
+	SegmentMPEGTS = "mpegts"
+	// SegmentFMP4 writes CMAF fragments (.m4s) after an init segment referenced with
+	// EXT-X-MAP, reusable for DASH.
+	SegmentFMP4 = "fmp4"
+)
+
+// InitSegment is the fMP4 initialization segment in every rendition directory.
+const InitSegment = "init.mp4"
+
+// ladderInitPattern is the init file name given to multi-variant ffmpeg commands; %v
+// expands to the variant name.
+const ladderInitPattern = "init_%v.mp4"
+
+// ValidSegmentType reports whether t names a supported segment container.
+func ValidSegmentType(t string) bool {
+	return t == SegmentMPEGTS || t == SegmentFMP4
+}
+
+func (o EncodeOptions) segmentType() string {
+	if o.SegmentType == "" {
+		return SegmentMPEGTS
+	}
+	return o.SegmentType
+}
+
+func (o EncodeOptions) segmentExt() string {
+	if o.segmentType() == SegmentFMP4 {
+		return ".m4s"
+	}
+	return ".ts"
+}
+
+// FinishLadder brings the output of BuildHLSLadderCommand to the per-rendition layout:
+// ffmpeg names fMP4 init segments after the variant, so they are renamed to InitSegment
+// and the EXT-X-MAP reference is updated. An unexpanded ladderInitPattern, which ffmpeg
+// leaves when it writes a single variant, is renamed the same way. It is a no-op for
+// MPEG-TS output. renditions are the variant names: the rung IDs, plus AudioRendition
+// when the command wrote one.
+func FinishLadder(outRoot string, renditions []string, opts EncodeOptions) error {
+	if opts.segmentType() != SegmentFMP4 {
+		return nil
+	}
+	for _, id := range renditions {
+		dir := filepath.Join(outRoot, id)
+		name := ""
+		for _, n := range []string{fmt.Sprintf("init_%s.mp4", id), ladderInitPattern} {
+			if _, err := os.Stat(filepath.Join(dir, n)); err == nil {
+				name = n
+				break
+			}
+		}
+		if name == "" {
+			continue // already named InitSegment
+		}
+		playlist := filepath.Join(dir, "index.m3u8")
+		b, err := os.ReadFile(playlist)
+		if err != nil {
+			return err
+		}
+		b = bytes.ReplaceAll(b, []byte(`URI="`+name+`"`), []byte(`URI="`+InitSegment+`"`))
+		if err := os.Rename(filepath.Join(dir, name), filepath.Join(dir, InitSegment)); err != nil {
+			return err
+		}
+		if err := os.WriteFile(playlist, b, 0o644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package ffmpeg
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Variant describes an encoded HLS rendition as it will appear in the master playlist.
+type Variant struct {
+	Width     int     `json:"width"`
+	Height    int     `json:"height"`
+	FrameRate float64 `json:"frameRate"`
+	Codecs    string  `json:"codecs"`
+	// Bandwidth is the peak segment bitrate and AverageBandwidth the bitrate over the
+	// whole rendition, both in bit/s and including container overhead.
+	Bandwidth        int `json:"bandwidth"`
+	AverageBandwidth int `json:"averageBandwidth"`
+	// Duration is the summed segment duration in seconds.
+	Duration float64 `json:"duration,omitempty"`
+}
+
+// MeasureVariant inspects the rendition written to dir (index.m3u8 and its segments):
+// the bitrates come from segment sizes and durations, the rest from probing the playlist,
+// which works for both MPEG-TS and fMP4 segments. An audio-only rendition has no
+// dimensions or frame rate.
+func MeasureVariant(ctx context.Context, dir string) (*Variant, error) {
+	segs, err := ReadMediaPlaylist(filepath.Join(dir, "index.m3u8"))
+	if err != nil {
+		return nil, err
+	}
+	if len(segs) == 0 {
+		return nil, fmt.Errorf("%s: playlist has no segments", dir)
+	}
+	v := &Variant{}
+	var totalBytes int64
+	var totalDur float64
+	for _, seg := range segs {
+		fi, err := os.Stat(filepath.Join(dir, seg.URI))
+		if err != nil {
+			return nil, err
+		}
+		totalBytes += fi.Size()
+		totalDur += seg.Duration
+		if seg.Duration > 0 {
+			if bps := int(math.Ceil(float64(fi.Size()*8) / seg.Duration)); bps > v.Bandwidth {
+				v.Bandwidth = bps
+			}
+		}
+	}
+	v.Duration = totalDur
+	if totalDur > 0 {
+		v.AverageBandwidth = int(math.Ceil(float64(totalBytes*8) / totalDur))
+	}
+
+	p, err := probeStreams(ctx, filepath.Join(dir, "index.m3u8"))
+	if err != nil {
+		return nil, err
+	}
+	var codecs []string
+	if p.VideoCodec != "" {
+		v.Width, v.Height, v.FrameRate = p.DisplayWidth(), p.DisplayHeight(), p.FrameRate
+		codecs = append(codecs, VideoCodecString(p))
+	}
+	if p.AudioCodec != "" {
+		codecs = append(codecs, AudioCodecString(p))
+	}
+	v.Codecs = strings.Join(codecs, ",")
+	return v, nil
+}
+
+// MediaSegment is one segment entry of an HLS media playlist.
+type MediaSegment struct {
+	URI      string
+	Duration float64 // seconds, from #EXTINF
+}
+
+// ReadMediaPlaylist returns the segments listed in an HLS media playlist.
+func ReadMediaPlaylist(path string) ([]MediaSegment, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var segs []MediaSegment
+	var dur float64
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		switch {
+		case strings.HasPrefix(line, "#EXTINF:"):
+			d, _, _ := strings.Cut(strings.TrimPrefix(line, "#EXTINF:"), ",")
+			dur, _ = strconv.ParseFloat(d, 64)
+		case line == "" || strings.HasPrefix(line, "#"):
+		default:
+			segs = append(segs, MediaSegment{URI: line, Duration: dur})
+			dur = 0
+		}
+	}
+	return segs, sc.Err()
+}
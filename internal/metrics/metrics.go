@@ -0,0 +1,25 @@
+// Package metrics holds the Prometheus collectors exported on /metrics.
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// WorkerProgress is the completion percentage of the job each consumer worker is running.
+var WorkerProgress = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "transcoder_worker_progress_percent",
+	Help: "Transcode progress (0-100) of the job currently handled by each worker.",
+}, []string{"worker"})
+
+// AMQPReconnects counts successful reconnects to RabbitMQ after a connection loss.
+var AMQPReconnects = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "transcoder_amqp_reconnects_total",
+	Help: "Number of times the RabbitMQ connection was re-established.",
+})
+
+// AMQPConnected is 1 while the RabbitMQ connection is up.
+var AMQPConnected = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "transcoder_amqp_connected",
+	Help: "Whether the RabbitMQ connection is currently up (1) or down (0).",
+})
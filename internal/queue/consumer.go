@@ -5,10 +5,13 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"sync"
 	"time"
 
 	amqp "github.com/rabbitmq/amqp091-go"
 	"go.uber.org/zap"
+
+	"github.com/streamhive/transcoder/internal/metrics"
 )
 
 // Consumer wraps RabbitMQ consumption.
@@ -20,6 +23,19 @@ type Consumer struct {
 	exchange         string
 	uploadRoutingKey string
 	queueName        string
+
+	dlx         string
+	dlq         string
+	retryDelays []time.Duration
+	maxAttempts int
+	// confirmTimeout bounds the wait for the broker to confirm a retry or DLQ republish.
+	confirmTimeout time.Duration
+
+	reconnectBackoff    time.Duration
+	reconnectMaxBackoff time.Duration
+
+	mu          sync.Mutex // guards conn and onReconnect
+	onReconnect []func(*amqp.Connection) error
 }
 
 func GetEnvInt(name string, def int) int {
@@ -49,107 +65,232 @@ func NewConsumerFromEnv(log *zap.SugaredLogger) (*Consumer, error) {
 		uploadRoutingKey: getEnv("AMQP_UPLOAD_ROUTING_KEY", "video.uploaded"),
 		queueName:        getEnv("AMQP_QUEUE", "transcoder.video.uploaded"),
 	}
+	c.dlx = getEnv("AMQP_DLX", c.exchange+".dlx")
+	c.dlq = getEnv("AMQP_DLQ", c.queueName+".dlq")
+	c.retryDelays = parseDelays(getEnv("AMQP_RETRY_DELAYS_MS", "10000,60000,300000"))
+	c.maxAttempts = GetEnvInt("AMQP_MAX_ATTEMPTS", len(c.retryDelays)+1)
+	c.confirmTimeout = time.Duration(GetEnvInt("TRANSCODER_PUB_CONFIRM_TIMEOUT_MS", 5000)) * time.Millisecond
+
+	c.reconnectBackoff = time.Duration(GetEnvInt("AMQP_CONNECT_BACKOFF_MS", 1000)) * time.Millisecond
+	c.reconnectMaxBackoff = time.Duration(GetEnvInt("AMQP_RECONNECT_MAX_BACKOFF_MS", 30000)) * time.Millisecond
 
 	retries := GetEnvInt("AMQP_CONNECT_RETRIES", 30)
-	backoffMS := GetEnvInt("AMQP_CONNECT_BACKOFF_MS", 1000)
 
 	var conn *amqp.Connection
 	var err error
 	for attempt := 1; attempt <= retries; attempt++ {
-		conn, err = amqp.DialConfig(c.url, amqp.Config{Properties: amqp.Table{"connection_name": "transcoder"}})
+		conn, err = c.dial()
 		if err == nil {
 			break
 		}
 		log.Warnw("amqp dial failed, retrying", "attempt", attempt, "err", err)
-		time.Sleep(time.Duration(backoffMS) * time.Millisecond)
+		time.Sleep(c.reconnectBackoff)
 	}
 	if err != nil {
 		return nil, fmt.Errorf("amqp dial: %w", err)
 	}
+	if err := c.declareTopology(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
 	c.conn = conn
+	metrics.AMQPConnected.Set(1)
+	return c, nil
+}
+
+func (c *Consumer) dial() (*amqp.Connection, error) {
+	return amqp.DialConfig(c.url, amqp.Config{Properties: amqp.Table{"connection_name": "transcoder"}})
+}
 
-	// Ensure exchange/queue exist once using a setup channel
+// declareTopology ensures the exchange, work queue and retry/DLQ queues exist using a
+// short-lived setup channel. It runs on every (re)connect.
+func (c *Consumer) declareTopology(conn *amqp.Connection) error {
 	ch, err := conn.Channel()
 	if err != nil {
-		c.conn.Close()
-		return nil, fmt.Errorf("channel: %w", err)
+		return fmt.Errorf("channel: %w", err)
 	}
 	defer ch.Close()
 
 	if err := ch.ExchangeDeclare(c.exchange, "topic", true, false, false, false, nil); err != nil {
-		return nil, fmt.Errorf("exchange declare: %w", err)
+		return fmt.Errorf("exchange declare: %w", err)
 	}
 	q, err := ch.QueueDeclare(c.queueName, true, false, false, false, nil)
 	if err != nil {
-		return nil, fmt.Errorf("queue declare: %w", err)
+		return fmt.Errorf("queue declare: %w", err)
 	}
 	if err := ch.QueueBind(q.Name, c.uploadRoutingKey, c.exchange, false, nil); err != nil {
-		return nil, fmt.Errorf("queue bind: %w", err)
+		return fmt.Errorf("queue bind: %w", err)
 	}
-	return c, nil
+	return c.declareRetryTopology(ch)
+}
+
+// reconnect dials with exponential backoff until it succeeds or ctx is done, then
+// re-declares the topology and notifies OnReconnect callbacks.
+func (c *Consumer) reconnect(ctx context.Context) error {
+	backoff := c.reconnectBackoff
+	for attempt := 1; ; attempt++ {
+		conn, err := c.dial()
+		if err == nil {
+			if err = c.declareTopology(conn); err != nil {
+				conn.Close()
+			}
+		}
+		if err == nil {
+			c.mu.Lock()
+			c.conn = conn
+			callbacks := append([]func(*amqp.Connection) error(nil), c.onReconnect...)
+			c.mu.Unlock()
+			metrics.AMQPReconnects.Inc()
+			metrics.AMQPConnected.Set(1)
+			for _, fn := range callbacks {
+				if err := fn(conn); err != nil {
+					c.log.Errorw("reconnect callback failed", "err", err)
+				}
+			}
+			c.log.Infow("amqp reconnected", "attempt", attempt)
+			return nil
+		}
+		c.log.Warnw("amqp reconnect failed, retrying", "attempt", attempt, "backoff", backoff, "err", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > c.reconnectMaxBackoff {
+			backoff = c.reconnectMaxBackoff
+		}
+	}
+}
+
+// OnReconnect registers fn to run with the new connection after every reconnect, e.g. to
+// rebuild publisher channels.
+func (c *Consumer) OnReconnect(fn func(*amqp.Connection) error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onReconnect = append(c.onReconnect, fn)
 }
 
 func (c *Consumer) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	if c.conn != nil {
 		_ = c.conn.Close()
 	}
 }
 
 // Conn returns the underlying AMQP connection for creating publishers.
-func (c *Consumer) Conn() *amqp.Connection { return c.conn }
+func (c *Consumer) Conn() *amqp.Connection {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn
+}
 
 // Exchange returns the configured exchange name.
 func (c *Consumer) Exchange() string { return c.exchange }
 
+type workerKey struct{}
+
+// WorkerID returns the index of the consumer worker handling the message, or "" when ctx
+// did not come from Consume.
+func WorkerID(ctx context.Context) string {
+	if v, ok := ctx.Value(workerKey{}).(int); ok {
+		return strconv.Itoa(v)
+	}
+	return ""
+}
+
 // Consume starts N independent consumers (one channel per worker) and calls handler per message.
-func (c *Consumer) Consume(ctx context.Context, workers int, handler func([]byte) error) error {
+// The context passed to handler carries the worker index, see WorkerID.
+//
+// Consume supervises the connection: when it closes, or a worker loses its channel, the
+// in-flight handlers are cancelled (their messages are redelivered by the broker), the
+// connection is re-established with backoff and all N workers are restarted.
+func (c *Consumer) Consume(ctx context.Context, workers int, handler func(context.Context, []byte) error) error {
 	if workers < 1 {
 		workers = 1
 	}
-	errCh := make(chan error, workers)
-	for i := 0; i < workers; i++ {
-		go func(idx int) {
-			ch, err := c.conn.Channel()
-			if err != nil {
-				errCh <- fmt.Errorf("worker %d channel: %w", idx, err)
-				return
-			}
-			defer ch.Close()
-
-			// Fair dispatch
-			_ = ch.Qos(1, 0, false)
-			consumerTag := fmt.Sprintf("transcoder-%d-%d", os.Getpid(), idx)
-			deliveries, err := ch.Consume(c.queueName, consumerTag, false, false, false, false, nil)
-			if err != nil {
-				errCh <- fmt.Errorf("worker %d consume: %w", idx, err)
-				return
-			}
-
-			for {
-				select {
-				case <-ctx.Done():
-					return
-				case d, ok := <-deliveries:
-					if !ok {
-						return
-					}
-					start := time.Now()
-					if err := handler(d.Body); err != nil {
-						c.log.Errorw("handler error", "err", err)
-						_ = d.Nack(false, false) // send to DLQ if configured
-						continue
-					}
-					_ = d.Ack(false)
-					c.log.Debugw("processed message", "ms", time.Since(start).Milliseconds())
+	for {
+		conn := c.Conn()
+		closed := conn.NotifyClose(make(chan *amqp.Error, 1))
+		wctx, cancel := context.WithCancel(ctx)
+		errCh := make(chan error, workers)
+		var wg sync.WaitGroup
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func(idx int) {
+				defer wg.Done()
+				if err := c.work(wctx, conn, idx, handler); err != nil {
+					errCh <- err
 				}
-			}
-		}(i)
+			}(i)
+		}
+
+		var cause error
+		select {
+		case <-ctx.Done():
+		case amqpErr := <-closed:
+			cause = fmt.Errorf("connection closed: %v", amqpErr)
+		case cause = <-errCh:
+		}
+		cancel()
+		wg.Wait()
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		metrics.AMQPConnected.Set(0)
+		c.log.Errorw("amqp consumer interrupted, reconnecting", "err", cause)
+		_ = conn.Close()
+		if err := c.reconnect(ctx); err != nil {
+			return nil // ctx cancelled while reconnecting
+		}
 	}
+}
 
-	select {
-	case <-ctx.Done():
-		return nil
-	case err := <-errCh:
-		return err
+// work runs one consumer worker on its own channel until ctx is done or the channel closes.
+func (c *Consumer) work(ctx context.Context, conn *amqp.Connection, idx int, handler func(context.Context, []byte) error) error {
+	ch, err := conn.Channel()
+	if err != nil {
+		return fmt.Errorf("worker %d channel: %w", idx, err)
+	}
+	defer ch.Close()
+	// Failed messages are republished on this channel and only acked once confirmed.
+	if err := ch.Confirm(false); err != nil {
+		return fmt.Errorf("worker %d confirm mode: %w", idx, err)
+	}
+	republish := &confirmChannel{ch: ch} // never mandatory, so it needs no return listener
+	wctx := context.WithValue(ctx, workerKey{}, idx)
+
+	// Fair dispatch
+	_ = ch.Qos(1, 0, false)
+	consumerTag := fmt.Sprintf("transcoder-%d-%d", os.Getpid(), idx)
+	deliveries, err := ch.Consume(c.queueName, consumerTag, false, false, false, false, nil)
+	if err != nil {
+		return fmt.Errorf("worker %d consume: %w", idx, err)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case d, ok := <-deliveries:
+			if !ok {
+				return fmt.Errorf("worker %d: delivery channel closed", idx)
+			}
+			start := time.Now()
+			info := c.attemptInfo(d)
+			mctx := context.WithValue(wctx, attemptKey{}, info)
+			if err := handler(mctx, d.Body); err != nil {
+				if ctx.Err() != nil {
+					// Cancelled by shutdown or reconnect; the broker redelivers the message.
+					return nil
+				}
+				c.log.Errorw("handler error", "attempt", info.attempt, "err", err)
+				c.handleFailure(ctx, republish, d, info, err)
+				continue
+			}
+			_ = d.Ack(false)
+			c.log.Debugw("processed message", "ms", time.Since(start).Milliseconds())
+		}
 	}
 }
@@ -2,41 +2,219 @@ package queue
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"strconv"
+	"sync"
 	"time"
 
 	amqp "github.com/rabbitmq/amqp091-go"
 	"github.com/sony/gobreaker"
 )
 
+var (
+	// ErrNacked is returned when the broker negatively acknowledges a publish.
+	ErrNacked = errors.New("publish nacked by broker")
+	// ErrUnroutable is returned when a mandatory publish matched no queue.
+	ErrUnroutable = errors.New("publish unroutable")
+)
+
+// Publisher publishes JSON events with confirms. It is safe for concurrent use: each
+// publish borrows a confirm channel from a fixed-size pool, so no amqp channel is ever
+// used by two goroutines at once.
 type Publisher struct {
-	ch       *amqp.Channel
 	exchange string
 	routing  string
 	breaker  *gobreaker.CircuitBreaker
+
+	confirmTimeout time.Duration
+
+	mu   sync.RWMutex // guards open and gen, which change on reconnect
+	open func() (publishChannel, error)
+	gen  int
+
+	// pool holds one slot per allowed channel; an empty slot (nil channel) is opened on demand.
+	pool chan pooledChannel
 }
 
-func NewPublisher(conn *amqp.Connection, exchange, routing string) (*Publisher, error) {
+// publishChannel is a confirm-mode channel. Implementations need not be goroutine safe.
+type publishChannel interface {
+	publish(ctx context.Context, exchange, routing string, msg amqp.Publishing, mandatory bool, timeout time.Duration) error
+	isClosed() bool
+	close()
+}
+
+type pooledChannel struct {
+	ch  publishChannel
+	gen int
+}
+
+// confirmChannel is a channel in confirm mode with its basic.return listener.
+type confirmChannel struct {
+	ch      *amqp.Channel
+	returns chan amqp.Return
+}
+
+func newConfirmChannel(conn *amqp.Connection) (publishChannel, error) {
 	ch, err := conn.Channel()
 	if err != nil {
 		return nil, err
 	}
+	if err := ch.Confirm(false); err != nil {
+		_ = ch.Close()
+		return nil, fmt.Errorf("confirm mode: %w", err)
+	}
+	return &confirmChannel{ch: ch, returns: ch.NotifyReturn(make(chan amqp.Return, 16))}, nil
+}
+
+// publish sends msg and waits for the broker's confirm. For a mandatory publish the
+// broker sends basic.return before the ack of an unroutable message, so once the ack is
+// in any matching return is already buffered.
+func (c *confirmChannel) publish(ctx context.Context, exchange, routing string, msg amqp.Publishing, mandatory bool, timeout time.Duration) error {
+	dc, err := c.ch.PublishWithDeferredConfirmWithContext(ctx, exchange, routing, mandatory, false, msg)
+	if err != nil {
+		return err
+	}
+	wctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	acked, err := dc.WaitContext(wctx)
+	if err != nil {
+		return fmt.Errorf("publish confirm: %w", err)
+	}
+	if !acked {
+		return ErrNacked
+	}
+	if !mandatory {
+		return nil
+	}
+	for {
+		select {
+		case r := <-c.returns:
+			if r.MessageId == msg.MessageId {
+				return fmt.Errorf("%w: %s (%d %s)", ErrUnroutable, r.RoutingKey, r.ReplyCode, r.ReplyText)
+			}
+		default:
+			return nil
+		}
+	}
+}
+
+func (c *confirmChannel) isClosed() bool { return c.ch.IsClosed() }
+
+func (c *confirmChannel) close() { _ = c.ch.Close() }
+
+func NewPublisher(conn *amqp.Connection, exchange, routing string) (*Publisher, error) {
+	open := func() (publishChannel, error) { return newConfirmChannel(conn) }
+	p := newPublisher(open, exchange, routing, GetEnvInt("TRANSCODER_PUB_CHANNELS", 4))
+	// Open one channel eagerly so a broken connection fails at startup.
+	pc, err := p.acquire(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	p.release(pc, nil)
+	return p, nil
+}
+
+func newPublisher(open func() (publishChannel, error), exchange, routing string, channels int) *Publisher {
 	cbTimeout := 5 * time.Second
 	if v := getEnv("TRANSCODER_PUB_CB_RESET_MS", ""); v != "" { if d, err := time.ParseDuration(v+"ms"); err == nil { cbTimeout = d } }
 	cbFailures := uint32(5)
 	if v := getEnv("TRANSCODER_PUB_CB_FAILS", ""); v != "" { if n, err := strconv.Atoi(v); err == nil && n > 0 { cbFailures = uint32(n) } }
 	breaker := gobreaker.NewCircuitBreaker(gobreaker.Settings{ Name: "amqp-publish", Timeout: cbTimeout, ReadyToTrip: func(c gobreaker.Counts) bool { return c.ConsecutiveFailures >= cbFailures } })
-	return &Publisher{ch: ch, exchange: exchange, routing: routing, breaker: breaker}, nil
+	confirmTimeout := time.Duration(GetEnvInt("TRANSCODER_PUB_CONFIRM_TIMEOUT_MS", 5000)) * time.Millisecond
+	if channels < 1 {
+		channels = 1
+	}
+	pool := make(chan pooledChannel, channels)
+	for i := 0; i < channels; i++ {
+		pool <- pooledChannel{}
+	}
+	return &Publisher{exchange: exchange, routing: routing, breaker: breaker, confirmTimeout: confirmTimeout, open: open, pool: pool}
+}
+
+// acquire takes a slot from the pool, opening a channel if the slot is empty, closed or
+// belongs to a connection that has since been replaced.
+func (p *Publisher) acquire(ctx context.Context) (pooledChannel, error) {
+	var pc pooledChannel
+	select {
+	case pc = <-p.pool:
+	case <-ctx.Done():
+		return pc, ctx.Err()
+	}
+	p.mu.RLock()
+	open, gen := p.open, p.gen
+	p.mu.RUnlock()
+	if pc.ch != nil && (pc.gen != gen || pc.ch.isClosed()) {
+		pc.ch.close()
+		pc.ch = nil
+	}
+	if pc.ch == nil {
+		ch, err := open()
+		if err != nil {
+			p.pool <- pooledChannel{}
+			return pooledChannel{}, err
+		}
+		pc = pooledChannel{ch: ch, gen: gen}
+	}
+	return pc, nil
+}
+
+// release returns a slot to the pool. A channel whose publish failed for a reason other
+// than a nack or return may be in an unknown state and is discarded.
+func (p *Publisher) release(pc pooledChannel, err error) {
+	if err != nil && !errors.Is(err, ErrNacked) && !errors.Is(err, ErrUnroutable) {
+		pc.ch.close()
+		pc.ch = nil
+	}
+	p.pool <- pc
+}
+
+func (p *Publisher) publish(ctx context.Context, routing string, msg amqp.Publishing, mandatory bool) error {
+	pc, err := p.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	err = pc.ch.publish(ctx, p.exchange, routing, msg, mandatory, p.confirmTimeout)
+	p.release(pc, err)
+	return err
 }
 
+// Close waits for in-flight publishes to hand back their channels and closes them all.
 func (p *Publisher) Close() {
-	if p.ch != nil {
-		_ = p.ch.Close()
+	slots := make([]pooledChannel, 0, cap(p.pool))
+	for i := 0; i < cap(p.pool); i++ {
+		slots = append(slots, <-p.pool)
 	}
+	for _, pc := range slots {
+		if pc.ch != nil {
+			pc.ch.close()
+		}
+		p.pool <- pooledChannel{}
+	}
+}
+
+// Reconnect points the publisher at conn. Channels opened on the old connection are
+// dropped as they come back to the pool. It is meant to be registered with
+// Consumer.OnReconnect.
+func (p *Publisher) Reconnect(conn *amqp.Connection) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.open = func() (publishChannel, error) { return newConfirmChannel(conn) }
+	p.gen++
+	return nil
 }
 
+// PublishJSON publishes v with the publisher's default routing key.
 func (p *Publisher) PublishJSON(ctx context.Context, v any) error {
+	return p.PublishJSONTo(ctx, p.routing, v)
+}
+
+// PublishJSONTo publishes v on the publisher's exchange with the given routing key. A
+// publish only succeeds once the broker confirms it and it was routed to a queue.
+func (p *Publisher) PublishJSONTo(ctx context.Context, routing string, v any) error {
 	b, err := json.Marshal(v)
 	if err != nil {
 		return err
@@ -47,11 +225,14 @@ func (p *Publisher) PublishJSON(ctx context.Context, v any) error {
 	var last error
 	backoff := 200 * time.Millisecond
 	for i := 0; i <= retries; i++ {
+		msg := amqp.Publishing{
+			ContentType:  "application/json",
+			DeliveryMode: amqp.Persistent,
+			MessageId:    newMessageID(),
+			Body:         b,
+		}
 		_, err = p.breaker.Execute(func() (interface{}, error) {
-			return nil, p.ch.PublishWithContext(ctx, p.exchange, p.routing, false, false, amqp.Publishing{
-				ContentType: "application/json",
-				Body:        b,
-			})
+			return nil, p.publish(ctx, routing, msg, true)
 		})
 		if err == nil { return nil }
 		last = err
@@ -59,3 +240,25 @@ func (p *Publisher) PublishJSON(ctx context.Context, v any) error {
 	}
 	return last
 }
+
+// PublishJSONBestEffort publishes v once, without the mandatory flag, retries or the
+// circuit breaker. It is meant for advisory events such as progress, which may have no
+// bound queue and must not trip the breaker guarding the events that matter.
+func (p *Publisher) PublishJSONBestEffort(ctx context.Context, routing string, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return p.publish(ctx, routing, amqp.Publishing{
+		ContentType:  "application/json",
+		DeliveryMode: amqp.Persistent,
+		MessageId:    newMessageID(),
+		Body:         b,
+	}, false)
+}
+
+func newMessageID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
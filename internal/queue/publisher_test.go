@@ -0,0 +1,189 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/sony/gobreaker"
+)
+
+// fakeBroker stands in for RabbitMQ. It hands out channels that fail the test if two
+// goroutines ever publish on the same one, and only routes keys in bound.
+type fakeBroker struct {
+	t     *testing.T
+	bound map[string]bool
+
+	fail error // returned by every publish when set
+
+	mu        sync.Mutex
+	delivered map[string]int
+	sent      []fakeMessage
+	opened    int
+	open      int32 // channels currently in use by a publish
+	maxOpen   int32
+}
+
+type fakeMessage struct {
+	exchange, routing string
+	msg               amqp.Publishing
+}
+
+type fakeChannel struct {
+	b      *fakeBroker
+	inUse  int32
+	closed atomic.Bool
+}
+
+func newFakeBroker(t *testing.T, bound ...string) *fakeBroker {
+	b := &fakeBroker{t: t, bound: map[string]bool{}, delivered: map[string]int{}}
+	for _, k := range bound {
+		b.bound[k] = true
+	}
+	return b
+}
+
+func (b *fakeBroker) openChannel() (publishChannel, error) {
+	b.mu.Lock()
+	b.opened++
+	b.mu.Unlock()
+	return &fakeChannel{b: b}, nil
+}
+
+func (c *fakeChannel) publish(ctx context.Context, exchange, routing string, msg amqp.Publishing, mandatory bool, timeout time.Duration) error {
+	if !atomic.CompareAndSwapInt32(&c.inUse, 0, 1) {
+		c.b.t.Errorf("concurrent publish on one channel")
+		return errors.New("channel in use")
+	}
+	defer atomic.StoreInt32(&c.inUse, 0)
+
+	n := atomic.AddInt32(&c.b.open, 1)
+	defer atomic.AddInt32(&c.b.open, -1)
+	for {
+		max := atomic.LoadInt32(&c.b.maxOpen)
+		if n <= max || atomic.CompareAndSwapInt32(&c.b.maxOpen, max, n) {
+			break
+		}
+	}
+
+	time.Sleep(100 * time.Microsecond) // widen the window for overlapping publishes
+	if c.b.fail != nil {
+		return c.b.fail
+	}
+	if !c.b.bound[routing] {
+		if !mandatory {
+			return nil // the broker drops it silently
+		}
+		return fmt.Errorf("%w: %s", ErrUnroutable, routing)
+	}
+	c.b.mu.Lock()
+	c.b.delivered[routing]++
+	c.b.sent = append(c.b.sent, fakeMessage{exchange: exchange, routing: routing, msg: msg})
+	c.b.mu.Unlock()
+	return nil
+}
+
+func (c *fakeChannel) isClosed() bool { return c.closed.Load() }
+
+func (c *fakeChannel) close() { c.closed.Store(true) }
+
+func TestPublisherConcurrentPublish(t *testing.T) {
+	const channels, workers, perWorker = 3, 16, 25
+	b := newFakeBroker(t, "video.transcoded", "video.transcoding.progress")
+	p := newPublisher(b.openChannel, "streamhive", "video.transcoded", channels)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				var err error
+				if i%2 == 0 {
+					err = p.PublishJSON(context.Background(), map[string]int{"worker": w, "i": i})
+				} else {
+					err = p.PublishJSONBestEffort(context.Background(), "video.transcoding.progress", map[string]int{"worker": w, "i": i})
+				}
+				if err != nil {
+					t.Errorf("publish: %v", err)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	p.Close()
+
+	total := b.delivered["video.transcoded"] + b.delivered["video.transcoding.progress"]
+	if total != workers*perWorker {
+		t.Fatalf("delivered %d messages, want %d", total, workers*perWorker)
+	}
+	if b.opened > channels {
+		t.Fatalf("opened %d channels, pool size is %d", b.opened, channels)
+	}
+	if b.maxOpen > channels {
+		t.Fatalf("%d publishes in flight at once, pool size is %d", b.maxOpen, channels)
+	}
+}
+
+func TestPublisherUnroutableTripsBreaker(t *testing.T) {
+	t.Setenv("TRANSCODER_PUB_RETRIES", "0")
+	t.Setenv("TRANSCODER_PUB_CB_FAILS", "2")
+	b := newFakeBroker(t)
+	p := newPublisher(b.openChannel, "streamhive", "video.transcoded", 2)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := p.PublishJSON(context.Background(), map[string]string{"k": "v"}); err == nil {
+				t.Errorf("expected unroutable publish to fail")
+			}
+		}()
+	}
+	wg.Wait()
+
+	err := p.PublishJSON(context.Background(), map[string]string{"k": "v"})
+	if !errors.Is(err, gobreaker.ErrOpenState) {
+		t.Fatalf("expected open breaker after repeated unroutable publishes, got %v", err)
+	}
+}
+
+func TestPublisherUnboundProgressDoesNotTripBreaker(t *testing.T) {
+	t.Setenv("TRANSCODER_PUB_RETRIES", "0")
+	t.Setenv("TRANSCODER_PUB_CB_FAILS", "2")
+	b := newFakeBroker(t, "video.transcoded")
+	p := newPublisher(b.openChannel, "streamhive", "video.transcoded", 2)
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				if err := p.PublishJSONBestEffort(context.Background(), "video.transcoding.progress", map[string]int{"worker": w, "i": i}); err != nil {
+					t.Errorf("progress publish: %v", err)
+				}
+				if i%5 == 0 {
+					if err := p.PublishJSON(context.Background(), map[string]int{"worker": w, "i": i}); err != nil {
+						t.Errorf("transcoded publish: %v", err)
+					}
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	p.Close()
+
+	if got, want := b.delivered["video.transcoded"], 4*4; got != want {
+		t.Fatalf("delivered %d transcoded events, want %d", got, want)
+	}
+	if st := p.breaker.State(); st != gobreaker.StateClosed {
+		t.Fatalf("breaker is %v after unrouted progress events, want closed", st)
+	}
+}
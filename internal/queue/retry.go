@@ -0,0 +1,199 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// permanentError marks a handler error that retrying cannot fix.
+type permanentError struct{ err error }
+
+func (e *permanentError) Error() string   { return e.err.Error() }
+func (e *permanentError) Unwrap() error   { return e.err }
+func (e *permanentError) Retryable() bool { return false }
+
+// Permanent wraps err so the consumer sends the message straight to the DLQ.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// IsRetryable reports whether a failed message should go through the retry queues.
+// Errors are retryable unless something in the chain says otherwise via Retryable() bool.
+func IsRetryable(err error) bool {
+	var r interface{ Retryable() bool }
+	if errors.As(err, &r) {
+		return r.Retryable()
+	}
+	return true
+}
+
+type attemptKey struct{}
+
+// attemptInfo describes the delivery being handled. retry tells whether a retryable
+// failure of this attempt goes to a retry queue rather than the DLQ.
+type attemptInfo struct {
+	attempt, max int
+	retry        bool
+}
+
+// DeliveryAttempt returns the 1-based attempt number of the message being handled and the
+// maximum number of attempts before it is dead-lettered. Both are 0 outside Consume.
+func DeliveryAttempt(ctx context.Context) (attempt, max int) {
+	if v, ok := ctx.Value(attemptKey{}).(attemptInfo); ok {
+		return v.attempt, v.max
+	}
+	return 0, 0
+}
+
+// WillRetry reports whether the consumer will schedule another attempt of the message
+// being handled if it fails with err. It is false outside Consume.
+func WillRetry(ctx context.Context, err error) bool {
+	v, ok := ctx.Value(attemptKey{}).(attemptInfo)
+	return ok && v.retry && IsRetryable(err)
+}
+
+// attemptInfo returns the attempt details of d.
+func (c *Consumer) attemptInfo(d amqp.Delivery) attemptInfo {
+	attempt := c.deliveryAttempt(d)
+	return attemptInfo{attempt: attempt, max: c.maxAttempts, retry: attempt < c.maxAttempts && len(c.retryDelays) > 0}
+}
+
+// parseDelays parses a comma separated list of millisecond delays.
+func parseDelays(s string) []time.Duration {
+	var out []time.Duration
+	for _, part := range strings.Split(s, ",") {
+		ms, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || ms <= 0 {
+			continue
+		}
+		out = append(out, time.Duration(ms)*time.Millisecond)
+	}
+	return out
+}
+
+func (c *Consumer) retryQueueName(delay time.Duration) string {
+	return fmt.Sprintf("%s.retry.%dms", c.queueName, delay.Milliseconds())
+}
+
+// declareRetryTopology declares the dead-letter exchange and queue plus one TTL queue per
+// retry delay. Expired retry messages are dead-lettered back onto the work queue through
+// the default exchange, so other subscribers of the upload routing key never see them.
+func (c *Consumer) declareRetryTopology(ch *amqp.Channel) error {
+	if err := ch.ExchangeDeclare(c.dlx, "direct", true, false, false, false, nil); err != nil {
+		return fmt.Errorf("dlx declare: %w", err)
+	}
+	if _, err := ch.QueueDeclare(c.dlq, true, false, false, false, nil); err != nil {
+		return fmt.Errorf("dlq declare: %w", err)
+	}
+	if err := ch.QueueBind(c.dlq, c.queueName, c.dlx, false, nil); err != nil {
+		return fmt.Errorf("dlq bind: %w", err)
+	}
+	for _, d := range c.retryDelays {
+		_, err := ch.QueueDeclare(c.retryQueueName(d), true, false, false, false, amqp.Table{
+			"x-message-ttl":             d.Milliseconds(),
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": c.queueName,
+		})
+		if err != nil {
+			return fmt.Errorf("retry queue declare: %w", err)
+		}
+	}
+	return nil
+}
+
+// attemptHeader carries the number of attempts a message has had. It is set on every
+// republish to a retry queue, because RabbitMQ 4 treats x-death as broker-managed and it
+// cannot be relied on to count trips through the retry queues.
+const attemptHeader = "x-transcoder-attempt"
+
+// deliveryAttempt returns the 1-based attempt number of d from attemptHeader. Messages
+// retried before the header existed fall back to counting x-death entries.
+func (c *Consumer) deliveryAttempt(d amqp.Delivery) int {
+	if n, ok := headerInt(d.Headers[attemptHeader]); ok && n > 0 {
+		return n + 1
+	}
+	deaths, _ := d.Headers["x-death"].([]interface{})
+	prefix := c.queueName + ".retry."
+	attempts := 1
+	for _, entry := range deaths {
+		t, ok := entry.(amqp.Table)
+		if !ok {
+			continue
+		}
+		if q, _ := t["queue"].(string); !strings.HasPrefix(q, prefix) {
+			continue
+		}
+		if n, ok := headerInt(t["count"]); ok {
+			attempts += n
+		}
+	}
+	return attempts
+}
+
+func headerInt(v interface{}) (int, bool) {
+	switch n := v.(type) {
+	case int64:
+		return int(n), true
+	case int32:
+		return int(n), true
+	case int:
+		return n, true
+	}
+	return 0, false
+}
+
+// handleFailure routes a failed delivery to the next retry tier, or to the DLQ when the
+// error is permanent or attempts are exhausted. The original is acked only once the broker
+// confirms the copy on ch, and requeued if the publish fails or is not confirmed, so it is
+// never lost.
+func (c *Consumer) handleFailure(ctx context.Context, ch publishChannel, d amqp.Delivery, info attemptInfo, herr error) {
+	attempt := info.attempt
+	headers := amqp.Table{}
+	for k, v := range d.Headers {
+		headers[k] = v
+	}
+	headers["x-transcoder-error"] = herr.Error()
+	headers[attemptHeader] = int32(attempt)
+
+	msg := amqp.Publishing{
+		Headers:       headers,
+		ContentType:   d.ContentType,
+		DeliveryMode:  amqp.Persistent,
+		CorrelationId: d.CorrelationId,
+		MessageId:     d.MessageId,
+		Timestamp:     d.Timestamp,
+		Type:          d.Type,
+		Body:          d.Body,
+	}
+
+	exchange, key := c.dlx, c.queueName
+	retry := IsRetryable(herr) && info.retry
+	if retry {
+		tier := attempt - 1
+		if tier >= len(c.retryDelays) {
+			tier = len(c.retryDelays) - 1
+		}
+		exchange, key = "", c.retryQueueName(c.retryDelays[tier])
+	}
+
+	if err := ch.publish(ctx, exchange, key, msg, false, c.confirmTimeout); err != nil {
+		c.log.Errorw("failed to route failed message, requeueing", "err", err)
+		_ = d.Nack(false, true)
+		return
+	}
+	_ = d.Ack(false)
+	if retry {
+		c.log.Warnw("message scheduled for retry", "attempt", attempt, "maxAttempts", c.maxAttempts, "queue", key)
+	} else {
+		c.log.Errorw("message dead-lettered", "attempt", attempt, "retryable", IsRetryable(herr), "dlq", c.dlq)
+	}
+}
@@ -0,0 +1,131 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"go.uber.org/zap"
+)
+
+func newTestConsumer(delays ...time.Duration) *Consumer {
+	return &Consumer{
+		log:            zap.NewNop().Sugar(),
+		queueName:      "transcoder.video.uploaded",
+		dlx:            "streamhive.dlx",
+		dlq:            "transcoder.video.uploaded.dlq",
+		retryDelays:    delays,
+		maxAttempts:    len(delays) + 1,
+		confirmTimeout: time.Second,
+	}
+}
+
+func TestDeliveryAttempt(t *testing.T) {
+	c := newTestConsumer(10*time.Second, time.Minute)
+	death := func(queue string, count any) amqp.Table { return amqp.Table{"queue": queue, "count": count} }
+	tests := []struct {
+		name    string
+		headers amqp.Table
+		want    int
+	}{
+		{"first delivery", nil, 1},
+		{"attempt header", amqp.Table{attemptHeader: int32(2)}, 3},
+		{"attempt header as int64", amqp.Table{attemptHeader: int64(1)}, 2},
+		{"attempt header wins over x-death", amqp.Table{
+			attemptHeader: int32(1),
+			"x-death":     []interface{}{death("transcoder.video.uploaded.retry.10000ms", int64(5))},
+		}, 2},
+		{"x-death fallback", amqp.Table{"x-death": []interface{}{
+			death("transcoder.video.uploaded.retry.10000ms", int64(1)),
+			death("transcoder.video.uploaded.retry.60000ms", int32(1)),
+		}}, 3},
+		{"x-death of other queues", amqp.Table{"x-death": []interface{}{death("other.retry.10000ms", int64(3))}}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := c.deliveryAttempt(amqp.Delivery{Headers: tt.headers}); got != tt.want {
+				t.Fatalf("deliveryAttempt = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+// fakeAcker records how handleFailure settled the original delivery.
+type fakeAcker struct {
+	acked, nacked, requeued bool
+}
+
+func (a *fakeAcker) Ack(tag uint64, multiple bool) error { a.acked = true; return nil }
+
+func (a *fakeAcker) Nack(tag uint64, multiple, requeue bool) error {
+	a.nacked, a.requeued = true, requeue
+	return nil
+}
+
+func (a *fakeAcker) Reject(tag uint64, requeue bool) error { return a.Nack(tag, false, requeue) }
+
+func TestHandleFailureRouting(t *testing.T) {
+	const queue = "transcoder.video.uploaded"
+	tests := []struct {
+		name     string
+		delays   []time.Duration
+		attempt  int
+		err      error
+		exchange string
+		routing  string
+	}{
+		{"first retry tier", []time.Duration{10 * time.Second, time.Minute}, 1, errors.New("boom"), "", queue + ".retry.10000ms"},
+		{"second retry tier", []time.Duration{10 * time.Second, time.Minute}, 2, errors.New("boom"), "", queue + ".retry.60000ms"},
+		{"attempts exhausted", []time.Duration{10 * time.Second, time.Minute}, 3, errors.New("boom"), "streamhive.dlx", queue},
+		{"permanent error", []time.Duration{10 * time.Second, time.Minute}, 1, Permanent(errors.New("bad input")), "streamhive.dlx", queue},
+		{"no retry delays", nil, 1, errors.New("boom"), "streamhive.dlx", queue},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestConsumer(tt.delays...)
+			b := newFakeBroker(t, tt.routing)
+			ch, _ := b.openChannel()
+			ack := &fakeAcker{}
+			d := amqp.Delivery{Acknowledger: ack, Body: []byte(`{}`), Headers: amqp.Table{"x-trace": "abc"}}
+			info := c.attemptInfo(amqp.Delivery{Headers: amqp.Table{attemptHeader: int32(tt.attempt - 1)}})
+
+			c.handleFailure(context.Background(), ch, d, info, tt.err)
+
+			if len(b.sent) != 1 {
+				t.Fatalf("published %d messages, want 1", len(b.sent))
+			}
+			m := b.sent[0]
+			if m.exchange != tt.exchange || m.routing != tt.routing {
+				t.Fatalf("routed to %q/%q, want %q/%q", m.exchange, m.routing, tt.exchange, tt.routing)
+			}
+			if got := m.msg.Headers[attemptHeader]; got != int32(tt.attempt) {
+				t.Errorf("%s = %v, want %d", attemptHeader, got, tt.attempt)
+			}
+			if m.msg.Headers["x-trace"] != "abc" {
+				t.Errorf("original headers not carried over: %v", m.msg.Headers)
+			}
+			if !ack.acked || ack.nacked {
+				t.Errorf("original acked=%v nacked=%v, want acked only", ack.acked, ack.nacked)
+			}
+			if retry := tt.exchange == ""; WillRetry(context.WithValue(context.Background(), attemptKey{}, info), tt.err) != retry {
+				t.Errorf("WillRetry disagrees with the routing decision")
+			}
+		})
+	}
+}
+
+func TestHandleFailureRequeuesWhenRepublishFails(t *testing.T) {
+	c := newTestConsumer(10 * time.Second)
+	b := newFakeBroker(t)
+	b.fail = ErrNacked
+	ch, _ := b.openChannel()
+	ack := &fakeAcker{}
+
+	c.handleFailure(context.Background(), ch, amqp.Delivery{Acknowledger: ack}, c.attemptInfo(amqp.Delivery{}), errors.New("boom"))
+
+	if ack.acked || !ack.nacked || !ack.requeued {
+		t.Fatalf("acked=%v nacked=%v requeued=%v, want a requeueing nack", ack.acked, ack.nacked, ack.requeued)
+	}
+}
@@ -1,9 +1,12 @@
 package storage
 
 import (
+	"bytes"
 	"context"
+	"crypto/md5"
+	"encoding/base64"
 	"fmt"
-	"io/fs"
+	"io"
 	"io/ioutil"
 	"mime"
 	"net/url"
@@ -14,8 +17,11 @@ import (
 	"strconv"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/streaming"
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blockblob"
 	"github.com/sony/gobreaker"
+	"golang.org/x/sync/errgroup"
 )
 
 // Helper function to read secret from file or fallback to environment variable
@@ -28,6 +34,7 @@ func getSecret(filePath, envVar string) string {
 
 type AzureClient struct {
 	service   *azblob.Client
+	account   string
 	container string
 	breaker   *gobreaker.CircuitBreaker
 }
@@ -66,76 +73,226 @@ func NewAzureClientFromEnv() (*AzureClient, error) {
 	if v := os.Getenv("TRANSCODER_CB_RESET_MS"); v != "" { if d, err := time.ParseDuration(v+"ms"); err == nil { cbTimeout = d } }
 	cbFailures := uint32(5)
 	if v := os.Getenv("TRANSCODER_CB_CONSECUTIVE_FAILS"); v != "" { if n, err := strconv.Atoi(v); err == nil && n > 0 { cbFailures = uint32(n) } }
-	breaker := gobreaker.NewCircuitBreaker(gobreaker.Settings{ Name: "azure-storage", Timeout: cbTimeout, ReadyToTrip: func(c gobreaker.Counts) bool { return c.ConsecutiveFailures >= cbFailures } })
-	return &AzureClient{service: svc, container: container, breaker: breaker}, nil
+	breaker := gobreaker.NewCircuitBreaker(gobreaker.Settings{ Name: "azure-storage", Timeout: cbTimeout, ReadyToTrip: func(c gobreaker.Counts) bool { return c.ConsecutiveFailures >= cbFailures }, IsSuccessful: breakerSuccess })
+	return &AzureClient{service: svc, account: acct, container: container, breaker: breaker}, nil
 }
 
-func (c *AzureClient) DownloadTo(ctx context.Context, blobPath, localPath string) error {
-	if err := os.MkdirAll(filepath.Dir(localPath), 0o755); err != nil {
-		return err
-	}
-	f, err := os.Create(filepath.Clean(localPath))
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-	attemptTimeout := 5 * time.Second
-	if v := os.Getenv("TRANSCODER_AZURE_TIMEOUT_MS"); v != "" { if d, err := time.ParseDuration(v+"ms"); err == nil { attemptTimeout = d } }
+// azureBlockSize is the unit for ranged downloads and staged uploads. Each block is
+// transferred, timed out and retried on its own, so a multi-GB blob is never at the mercy
+// of a single request.
+const azureBlockSize = 8 << 20
+
+// transferSettings returns the per-block timeout, per-block retries and the number of
+// blocks transferred in parallel.
+func transferSettings() (time.Duration, int, int) {
+	blockTimeout := 60 * time.Second
+	if v := os.Getenv("TRANSCODER_AZURE_TIMEOUT_MS"); v != "" { if d, err := time.ParseDuration(v+"ms"); err == nil { blockTimeout = d } }
 	retries := 2
 	if v := os.Getenv("TRANSCODER_AZURE_RETRIES"); v != "" { if n, err := strconv.Atoi(v); err == nil && n >= 0 { retries = n } }
+	concurrency := 4
+	if v := os.Getenv("TRANSCODER_AZURE_BLOCK_CONCURRENCY"); v != "" { if n, err := strconv.Atoi(v); err == nil && n > 0 { concurrency = n } }
+	return blockTimeout, retries, concurrency
+}
+
+// withRetry runs fn through the breaker with a fresh timeout per attempt. fn must be
+// idempotent: every attempt starts its transfer from scratch.
+func (c *AzureClient) withRetry(ctx context.Context, timeout time.Duration, retries int, fn func(ctx context.Context) error) error {
 	var last error
 	backoff := 200 * time.Millisecond
 	for i := 0; i <= retries; i++ {
-		dctx, cancel := context.WithTimeout(ctx, attemptTimeout)
-		_, err = c.breaker.Execute(func() (interface{}, error) { return c.service.DownloadFile(dctx, c.container, blobPath, f, nil) })
+		actx, cancel := context.WithTimeout(ctx, timeout)
+		_, err := c.breaker.Execute(func() (interface{}, error) { return nil, fn(actx) })
 		cancel()
-		if err == nil { return nil }
+		if err == nil {
+			return nil
+		}
 		last = err
-		if i < retries { time.Sleep(backoff); if backoff < 1500*time.Millisecond { backoff *= 2 } }
+		if ctx.Err() != nil || i == retries {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return last
+		case <-time.After(backoff):
+		}
+		if backoff < 1500*time.Millisecond {
+			backoff *= 2
+		}
 	}
 	return last
 }
 
-func (c *AzureClient) UploadFile(ctx context.Context, localPath, blobPath string, contentType string) error {
-	f, err := os.Open(filepath.Clean(localPath))
+// DownloadTo fetches the blob in ranged blocks written at their own offsets, so a retried
+// block simply overwrites its range. The result is checked against Content-MD5 when the
+// blob has one.
+func (c *AzureClient) DownloadTo(ctx context.Context, blobPath, localPath string) error {
+	if err := os.MkdirAll(filepath.Dir(localPath), 0o755); err != nil {
+		return err
+	}
+	blockTimeout, retries, concurrency := transferSettings()
+	bc := c.service.ServiceClient().NewContainerClient(c.container).NewBlobClient(blobPath)
+
+	var props blob.GetPropertiesResponse
+	err := c.withRetry(ctx, blockTimeout, retries, func(actx context.Context) (err error) {
+		props, err = bc.GetProperties(actx, nil)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	var size int64
+	if props.ContentLength != nil {
+		size = *props.ContentLength
+	}
+
+	f, err := os.OpenFile(filepath.Clean(localPath), os.O_CREATE|os.O_RDWR, 0o644)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
-	headers := &blob.HTTPHeaders{BlobContentType: &contentType}
-	attemptTimeout := 10 * time.Second
-	if v := os.Getenv("TRANSCODER_AZURE_TIMEOUT_MS"); v != "" { if d, err := time.ParseDuration(v+"ms"); err == nil { attemptTimeout = d } }
-	retries := 2
-	if v := os.Getenv("TRANSCODER_AZURE_RETRIES"); v != "" { if n, err := strconv.Atoi(v); err == nil && n >= 0 { retries = n } }
-	var last error
-	backoff := 200 * time.Millisecond
-	for i := 0; i <= retries; i++ {
-		uctx, cancel := context.WithTimeout(ctx, attemptTimeout)
-		_, err = c.breaker.Execute(func() (interface{}, error) { return c.service.UploadFile(uctx, c.container, blobPath, f, &azblob.UploadFileOptions{HTTPHeaders: headers}) })
-		cancel()
-		if err == nil { return nil }
-		last = err
-		if i < retries { time.Sleep(backoff); if backoff < 1500*time.Millisecond { backoff *= 2 } }
+	// Drop whatever an earlier attempt left behind.
+	if err := f.Truncate(size); err != nil {
+		return err
+	}
+
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(concurrency)
+	for off := int64(0); off < size; off += azureBlockSize {
+		off, n := off, min(azureBlockSize, size-off)
+		g.Go(func() error {
+			return c.withRetry(gctx, blockTimeout, retries, func(actx context.Context) error {
+				resp, err := bc.DownloadStream(actx, &blob.DownloadStreamOptions{Range: blob.HTTPRange{Offset: off, Count: n}})
+				if err != nil {
+					return err
+				}
+				defer resp.Body.Close()
+				written, err := io.Copy(io.NewOffsetWriter(f, off), io.LimitReader(resp.Body, n))
+				if err == nil && written != n {
+					err = fmt.Errorf("short read at offset %d: got %d of %d bytes", off, written, n)
+				}
+				return err
+			})
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return fmt.Errorf("download %s: %w", blobPath, err)
 	}
-	return last
-}
 
-func (c *AzureClient) UploadDir(ctx context.Context, localRoot, blobPrefix string) error {
-	return filepath.WalkDir(localRoot, func(path string, d fs.DirEntry, err error) error {
+	if len(props.ContentMD5) > 0 {
+		sum, err := fileMD5(f)
 		if err != nil {
 			return err
 		}
-		if d.IsDir() {
-			return nil
+		if !bytes.Equal(sum, props.ContentMD5) {
+			return fmt.Errorf("download %s: content MD5 mismatch", blobPath)
 		}
-		rel, err := filepath.Rel(localRoot, path)
-		if err != nil {
+	}
+	return nil
+}
+
+// UploadFile sends small files in one request and larger ones as staged blocks that are
+// retried individually before the block list is committed. Content-MD5 is set so later
+// downloads can be verified.
+func (c *AzureClient) UploadFile(ctx context.Context, localPath, blobPath string, contentType string) error {
+	f, err := os.Open(filepath.Clean(localPath))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := fi.Size()
+	sum, err := fileMD5(f)
+	if err != nil {
+		return err
+	}
+	headers := &blob.HTTPHeaders{BlobContentType: &contentType, BlobContentMD5: sum}
+	blockTimeout, retries, concurrency := transferSettings()
+	bb := c.service.ServiceClient().NewContainerClient(c.container).NewBlockBlobClient(blobPath)
+
+	if size <= azureBlockSize {
+		return c.withRetry(ctx, blockTimeout, retries, func(actx context.Context) error {
+			_, err := bb.Upload(actx, streaming.NopCloser(io.NewSectionReader(f, 0, size)), &blockblob.UploadOptions{HTTPHeaders: headers})
 			return err
+		})
+	}
+
+	var ids []string
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(concurrency)
+	for off := int64(0); off < size; off += azureBlockSize {
+		off, n := off, min(azureBlockSize, size-off)
+		// Block IDs must all have the same length; restaging an ID replaces the block.
+		id := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("block-%010d", off/azureBlockSize)))
+		ids = append(ids, id)
+		g.Go(func() error {
+			return c.withRetry(gctx, blockTimeout, retries, func(actx context.Context) error {
+				_, err := bb.StageBlock(actx, id, streaming.NopCloser(io.NewSectionReader(f, off, n)), nil)
+				return err
+			})
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return fmt.Errorf("upload %s: %w", blobPath, err)
+	}
+	return c.withRetry(ctx, blockTimeout, retries, func(actx context.Context) error {
+		_, err := bb.CommitBlockList(actx, ids, &blockblob.CommitBlockListOptions{HTTPHeaders: headers})
+		return err
+	})
+}
+
+func (c *AzureClient) Size(ctx context.Context, blobPath string) (int64, error) {
+	blockTimeout, retries, _ := transferSettings()
+	bc := c.service.ServiceClient().NewContainerClient(c.container).NewBlobClient(blobPath)
+	var size int64
+	err := c.withRetry(ctx, blockTimeout, retries, func(actx context.Context) error {
+		props, err := bc.GetProperties(actx, nil)
+		if err == nil && props.ContentLength != nil {
+			size = *props.ContentLength
 		}
-		blobName := filepath.ToSlash(filepath.Join(blobPrefix, rel))
-		ct := detectContentType(path)
-		return c.UploadFile(ctx, path, blobName, ct)
+		return err
 	})
+	return size, err
+}
+
+// ReadRange opens a single streaming request for the range. It is not retried: the
+// caller sees the error and can reissue the range.
+func (c *AzureClient) ReadRange(ctx context.Context, blobPath string, offset, length int64) (io.ReadCloser, error) {
+	bc := c.service.ServiceClient().NewContainerClient(c.container).NewBlobClient(blobPath)
+	res, err := c.breaker.Execute(func() (interface{}, error) {
+		return bc.DownloadStream(ctx, &blob.DownloadStreamOptions{Range: blob.HTTPRange{Offset: offset, Count: length}})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.(blob.DownloadStreamResponse).Body, nil
+}
+
+func fileMD5(f *os.File) ([]byte, error) {
+	h := md5.New()
+	if _, err := io.Copy(h, io.NewSectionReader(f, 0, 1<<62)); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+func (c *AzureClient) UploadDir(ctx context.Context, localRoot, blobPrefix string) (UploadStats, error) {
+	return uploadDir(ctx, localRoot, blobPrefix, uploadConcurrency(), c.UploadFile)
+}
+
+// PublicURL constructs the full Azure Blob Storage URL for a given blob path
+func (c *AzureClient) PublicURL(blobPath string) string {
+	if c.account == "" {
+		// Fallback to environment variable approach for backwards compatibility
+		if baseURL := os.Getenv("AZURE_PUBLIC_BASE"); baseURL != "" {
+			return fmt.Sprintf("%s/%s", baseURL, blobPath)
+		}
+		// Last resort: relative path, which clients outside the cluster cannot resolve
+		return fmt.Sprintf("/%s", blobPath)
+	}
+	return fmt.Sprintf("https://%s.blob.core.windows.net/%s/%s", c.account, c.container, blobPath)
 }
 
 func detectContentType(path string) string {
@@ -146,6 +303,15 @@ func detectContentType(path string) string {
 	if strings.HasSuffix(low, ".ts") {
 		return "video/MP2T"
 	}
+	if strings.HasSuffix(low, ".mpd") {
+		return "application/dash+xml"
+	}
+	if strings.HasSuffix(low, ".m4s") {
+		return "video/iso.segment"
+	}
+	if strings.HasSuffix(low, ".mp4") {
+		return "video/mp4"
+	}
 	if strings.HasSuffix(low, ".jpg") || strings.HasSuffix(low, ".jpeg") {
 		return "image/jpeg"
 	}
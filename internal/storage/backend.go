@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// Backend is the blob store the pipeline reads raw uploads from and writes outputs to.
+// Blob paths are slash separated and relative to the backend's container or bucket.
+type Backend interface {
+	DownloadTo(ctx context.Context, blobPath, localPath string) error
+	UploadFile(ctx context.Context, localPath, blobPath string, contentType string) error
+	// UploadDir uploads a directory tree concurrently, playlists last.
+	UploadDir(ctx context.Context, localRoot, blobPrefix string) (UploadStats, error)
+	DeleteBlobsWithPrefix(ctx context.Context, prefix string) error
+	BlobExists(ctx context.Context, blobPath string) (bool, error)
+	// Size returns the blob's length in bytes.
+	Size(ctx context.Context, blobPath string) (int64, error)
+	// ReadRange streams length bytes of the blob starting at offset.
+	ReadRange(ctx context.Context, blobPath string, offset, length int64) (io.ReadCloser, error)
+	// PublicURL returns the URL players and clients use to fetch blobPath.
+	PublicURL(blobPath string) string
+}
+
+// NewBackendFromEnv selects the backend from STORAGE_BACKEND: azure (default), local or s3.
+func NewBackendFromEnv() (Backend, error) {
+	switch kind := os.Getenv("STORAGE_BACKEND"); kind {
+	case "", "azure":
+		return NewAzureClientFromEnv()
+	case "local":
+		return NewLocalBackendFromEnv()
+	case "s3":
+		return NewS3BackendFromEnv()
+	default:
+		return nil, fmt.Errorf("unknown STORAGE_BACKEND %q", kind)
+	}
+}
+
+// breakerSuccess is the storage breakers' IsSuccessful. A request abandoned because the
+// caller cancelled it, e.g. a job shut down or a sibling block that failed, says nothing
+// about the service's health and must not trip the breaker.
+func breakerSuccess(err error) bool {
+	return err == nil || errors.Is(err, context.Canceled)
+}
+
+// UploadStats summarises an UploadDir call.
+type UploadStats struct {
+	Files int
+	Bytes int64
+}
+
+// uploadConcurrency is the number of files UploadDir sends in parallel.
+func uploadConcurrency() int {
+	if v := os.Getenv("TRANSCODER_UPLOAD_CONCURRENCY"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			return n
+		}
+	}
+	return 8
+}
+
+// isPlaylist reports whether path is a manifest that references other files.
+func isPlaylist(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".m3u8" || ext == ".mpd"
+}
+
+// uploadDir uploads every file under localRoot to blobPrefix with up to concurrency
+// uploads in flight; upload is expected to retry on its own. The first failure cancels
+// the rest. Playlists go up only after every segment has, so players never fetch a
+// playlist whose segments are missing.
+func uploadDir(ctx context.Context, localRoot, blobPrefix string, concurrency int, upload func(ctx context.Context, path, blobName, contentType string) error) (UploadStats, error) {
+	type file struct {
+		path, blobName string
+		size           int64
+	}
+	var media, playlists []file
+	err := filepath.WalkDir(localRoot, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(localRoot, path)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		f := file{path: path, blobName: filepath.ToSlash(filepath.Join(blobPrefix, rel)), size: info.Size()}
+		if isPlaylist(path) {
+			playlists = append(playlists, f)
+		} else {
+			media = append(media, f)
+		}
+		return nil
+	})
+	if err != nil {
+		return UploadStats{}, err
+	}
+
+	var files, bytes atomic.Int64
+	send := func(batch []file) error {
+		g, gctx := errgroup.WithContext(ctx)
+		g.SetLimit(concurrency)
+		for _, f := range batch {
+			f := f
+			g.Go(func() error {
+				if err := upload(gctx, f.path, f.blobName, detectContentType(f.path)); err != nil {
+					return fmt.Errorf("upload %s: %w", f.blobName, err)
+				}
+				files.Add(1)
+				bytes.Add(f.size)
+				return nil
+			})
+		}
+		return g.Wait()
+	}
+	err = send(media)
+	if err == nil {
+		err = send(playlists)
+	}
+	return UploadStats{Files: int(files.Load()), Bytes: bytes.Load()}, err
+}
@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func writeTree(t *testing.T, files ...string) string {
+	t.Helper()
+	root := t.TempDir()
+	for _, f := range files {
+		path := filepath.Join(root, filepath.FromSlash(f))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(f), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+var renditionTree = []string{
+	"manifest.mpd",
+	"720p/index.m3u8", "720p/init.mp4", "720p/index0.m4s", "720p/index1.m4s", "720p/index2.m4s",
+	"360p/index.m3u8", "360p/init.mp4", "360p/index0.m4s", "360p/index1.m4s",
+}
+
+func TestUploadDirPlaylistsLast(t *testing.T) {
+	root := writeTree(t, renditionTree...)
+	var mu sync.Mutex
+	var order []string
+	upload := func(ctx context.Context, path, blobName, contentType string) error {
+		mu.Lock()
+		order = append(order, blobName)
+		mu.Unlock()
+		return nil
+	}
+
+	stats, err := uploadDir(context.Background(), root, "hls/u/1", 4, upload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Files != len(renditionTree) {
+		t.Fatalf("uploaded %d files, want %d", stats.Files, len(renditionTree))
+	}
+	seenPlaylist := false
+	for _, name := range order {
+		if !strings.HasPrefix(name, "hls/u/1/") {
+			t.Errorf("blob %q is outside the prefix", name)
+		}
+		if isPlaylist(name) {
+			seenPlaylist = true
+		} else if seenPlaylist {
+			t.Fatalf("segment %q uploaded after a playlist: %v", name, order)
+		}
+	}
+}
+
+func TestUploadDirFailedSegmentSkipsPlaylists(t *testing.T) {
+	root := writeTree(t, renditionTree...)
+	boom := errors.New("boom")
+	var mu sync.Mutex
+	var playlists []string
+	upload := func(ctx context.Context, path, blobName, contentType string) error {
+		if strings.HasSuffix(blobName, "720p/index1.m4s") {
+			return boom
+		}
+		if isPlaylist(blobName) {
+			mu.Lock()
+			playlists = append(playlists, blobName)
+			mu.Unlock()
+		}
+		return nil
+	}
+
+	_, err := uploadDir(context.Background(), root, "hls/u/1", 4, upload)
+	if !errors.Is(err, boom) {
+		t.Fatalf("expected the segment upload error, got %v", err)
+	}
+	if len(playlists) > 0 {
+		t.Fatalf("playlists uploaded after a failed segment: %v", playlists)
+	}
+}
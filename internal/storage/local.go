@@ -0,0 +1,172 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// LocalBackend stores blobs as files under a root directory. It lets the pipeline run
+// without cloud credentials, e.g. in development or tests.
+type LocalBackend struct {
+	root       string
+	publicBase string
+}
+
+// NewLocalBackendFromEnv reads STORAGE_LOCAL_ROOT (required) and STORAGE_LOCAL_PUBLIC_BASE.
+func NewLocalBackendFromEnv() (*LocalBackend, error) {
+	root := os.Getenv("STORAGE_LOCAL_ROOT")
+	if root == "" {
+		return nil, fmt.Errorf("STORAGE_LOCAL_ROOT is required for the local backend")
+	}
+	return NewLocalBackend(root, os.Getenv("STORAGE_LOCAL_PUBLIC_BASE"))
+}
+
+// NewLocalBackend returns a backend rooted at root. publicBase, when set, is the URL the
+// root is served under; otherwise PublicURL returns file:// URLs.
+func NewLocalBackend(root, publicBase string) (*LocalBackend, error) {
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(abs, 0o755); err != nil {
+		return nil, err
+	}
+	return &LocalBackend{root: abs, publicBase: strings.TrimSuffix(publicBase, "/")}, nil
+}
+
+// path maps a blob path into the root, refusing paths that would escape it.
+func (b *LocalBackend) path(blobPath string) (string, error) {
+	p := filepath.Join(b.root, filepath.FromSlash(blobPath))
+	if p != b.root && !strings.HasPrefix(p, b.root+string(filepath.Separator)) {
+		return "", fmt.Errorf("blob path %q escapes storage root", blobPath)
+	}
+	return p, nil
+}
+
+func (b *LocalBackend) DownloadTo(ctx context.Context, blobPath, localPath string) error {
+	src, err := b.path(blobPath)
+	if err != nil {
+		return err
+	}
+	return copyFile(src, localPath)
+}
+
+func (b *LocalBackend) UploadFile(ctx context.Context, localPath, blobPath string, contentType string) error {
+	dst, err := b.path(blobPath)
+	if err != nil {
+		return err
+	}
+	return copyFile(localPath, dst)
+}
+
+func (b *LocalBackend) UploadDir(ctx context.Context, localRoot, blobPrefix string) (UploadStats, error) {
+	return uploadDir(ctx, localRoot, blobPrefix, uploadConcurrency(), b.UploadFile)
+}
+
+func (b *LocalBackend) DeleteBlobsWithPrefix(ctx context.Context, prefix string) error {
+	p, err := b.path(prefix)
+	if err != nil {
+		return err
+	}
+	// Blob prefixes are not necessarily directory boundaries ("hls/u/up" also matches
+	// "hls/u/upload2"), so match siblings by name.
+	dir, base := filepath.Dir(p), filepath.Base(p)
+	if p == b.root || strings.HasSuffix(prefix, "/") {
+		dir, base = p, ""
+	}
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), base) {
+			if err := os.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (b *LocalBackend) BlobExists(ctx context.Context, blobPath string) (bool, error) {
+	p, err := b.path(blobPath)
+	if err != nil {
+		return false, err
+	}
+	fi, err := os.Stat(p)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return !fi.IsDir(), nil
+}
+
+func (b *LocalBackend) Size(ctx context.Context, blobPath string) (int64, error) {
+	p, err := b.path(blobPath)
+	if err != nil {
+		return 0, err
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+func (b *LocalBackend) ReadRange(ctx context.Context, blobPath string, offset, length int64) (io.ReadCloser, error) {
+	p, err := b.path(blobPath)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.NewSectionReader(f, offset, length), f}, nil
+}
+
+func (b *LocalBackend) PublicURL(blobPath string) string {
+	if b.publicBase != "" {
+		return fmt.Sprintf("%s/%s", b.publicBase, blobPath)
+	}
+	u := url.URL{Scheme: "file", Path: filepath.ToSlash(filepath.Join(b.root, filepath.FromSlash(blobPath)))}
+	return u.String()
+}
+
+// copyFile copies src to dst through a temp file so readers never see a partial dst.
+func copyFile(src, dst string) error {
+	in, err := os.Open(filepath.Clean(src))
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, in); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
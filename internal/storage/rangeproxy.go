@@ -0,0 +1,121 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"path"
+	"time"
+)
+
+// RangeProxy serves a single blob over loopback HTTP with Range support, so ffmpeg can
+// read the source straight from storage without a full local copy. Every HTTP range is
+// translated into one ranged read against the backend.
+type RangeProxy struct {
+	URL string
+
+	srv *http.Server
+}
+
+// ServeBlob starts a RangeProxy for blobPath on 127.0.0.1. The URL carries a random
+// token and the blob's base name so ffmpeg can still guess the format from the extension.
+func ServeBlob(ctx context.Context, b Backend, blobPath string) (*RangeProxy, error) {
+	size, err := b.Size(ctx, blobPath)
+	if err != nil {
+		return nil, fmt.Errorf("stat %s: %w", blobPath, err)
+	}
+	var tok [12]byte
+	if _, err := rand.Read(tok[:]); err != nil {
+		return nil, err
+	}
+	route := fmt.Sprintf("/%s/%s", hex.EncodeToString(tok[:]), path.Base(blobPath))
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(route, func(w http.ResponseWriter, r *http.Request) {
+		rs := &blobReadSeeker{ctx: r.Context(), b: b, blobPath: blobPath, size: size}
+		defer rs.Close()
+		http.ServeContent(w, r, path.Base(blobPath), time.Time{}, rs)
+	})
+	p := &RangeProxy{
+		URL: fmt.Sprintf("http://%s%s", ln.Addr().String(), route),
+		srv: &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second},
+	}
+	go func() { _ = p.srv.Serve(ln) }()
+	return p, nil
+}
+
+// Close stops the proxy and aborts in-flight reads.
+func (p *RangeProxy) Close() error {
+	return p.srv.Close()
+}
+
+// blobReadSeeker adapts ranged backend reads to io.ReadSeeker for http.ServeContent.
+// A read after a seek opens one streaming request from the offset to the end of the blob.
+type blobReadSeeker struct {
+	ctx      context.Context
+	b        Backend
+	blobPath string
+	size     int64
+
+	off  int64
+	body io.ReadCloser
+}
+
+func (r *blobReadSeeker) Read(p []byte) (int, error) {
+	if r.off >= r.size {
+		return 0, io.EOF
+	}
+	if r.body == nil {
+		body, err := r.b.ReadRange(r.ctx, r.blobPath, r.off, r.size-r.off)
+		if err != nil {
+			return 0, err
+		}
+		r.body = body
+	}
+	n, err := r.body.Read(p)
+	r.off += int64(n)
+	if errors.Is(err, io.EOF) && r.off < r.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (r *blobReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	var abs int64
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = r.off + offset
+	case io.SeekEnd:
+		abs = r.size + offset
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if abs < 0 {
+		return 0, errors.New("negative position")
+	}
+	if abs != r.off {
+		r.Close()
+		r.off = abs
+	}
+	return abs, nil
+}
+
+func (r *blobReadSeeker) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
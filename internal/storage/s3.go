@@ -0,0 +1,159 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/sony/gobreaker"
+)
+
+// S3Backend talks to any S3-compatible object store, including MinIO.
+type S3Backend struct {
+	client     *minio.Client
+	bucket     string
+	endpoint   string
+	secure     bool
+	publicBase string
+	breaker    *gobreaker.CircuitBreaker
+}
+
+// NewS3BackendFromEnv reads S3_ENDPOINT, S3_ACCESS_KEY, S3_SECRET_KEY, S3_BUCKET,
+// S3_REGION, S3_USE_SSL and S3_PUBLIC_BASE.
+func NewS3BackendFromEnv() (*S3Backend, error) {
+	endpoint := os.Getenv("S3_ENDPOINT")
+	bucket := os.Getenv("S3_BUCKET")
+	if endpoint == "" || bucket == "" {
+		return nil, fmt.Errorf("S3_ENDPOINT and S3_BUCKET are required for the s3 backend")
+	}
+	secure := true
+	if v := os.Getenv("S3_USE_SSL"); v != "" {
+		secure, _ = strconv.ParseBool(v)
+	}
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(os.Getenv("S3_ACCESS_KEY"), os.Getenv("S3_SECRET_KEY"), ""),
+		Secure: secure,
+		Region: os.Getenv("S3_REGION"),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("s3 client: %w", err)
+	}
+	cbTimeout := 10 * time.Second
+	if v := os.Getenv("TRANSCODER_CB_RESET_MS"); v != "" {
+		if d, err := time.ParseDuration(v + "ms"); err == nil {
+			cbTimeout = d
+		}
+	}
+	cbFailures := uint32(5)
+	if v := os.Getenv("TRANSCODER_CB_CONSECUTIVE_FAILS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			cbFailures = uint32(n)
+		}
+	}
+	breaker := gobreaker.NewCircuitBreaker(gobreaker.Settings{Name: "s3-storage", Timeout: cbTimeout, ReadyToTrip: func(c gobreaker.Counts) bool { return c.ConsecutiveFailures >= cbFailures }, IsSuccessful: breakerSuccess})
+	return &S3Backend{
+		client:     client,
+		bucket:     bucket,
+		endpoint:   endpoint,
+		secure:     secure,
+		publicBase: strings.TrimSuffix(os.Getenv("S3_PUBLIC_BASE"), "/"),
+		breaker:    breaker,
+	}, nil
+}
+
+// The minio client retries transient failures itself; the breaker stops us hammering an
+// endpoint that is down.
+
+func (b *S3Backend) DownloadTo(ctx context.Context, blobPath, localPath string) error {
+	_, err := b.breaker.Execute(func() (interface{}, error) {
+		return nil, b.client.FGetObject(ctx, b.bucket, blobPath, localPath, minio.GetObjectOptions{})
+	})
+	return err
+}
+
+func (b *S3Backend) UploadFile(ctx context.Context, localPath, blobPath string, contentType string) error {
+	_, err := b.breaker.Execute(func() (interface{}, error) {
+		return b.client.FPutObject(ctx, b.bucket, blobPath, localPath, minio.PutObjectOptions{ContentType: contentType})
+	})
+	return err
+}
+
+func (b *S3Backend) UploadDir(ctx context.Context, localRoot, blobPrefix string) (UploadStats, error) {
+	return uploadDir(ctx, localRoot, blobPrefix, uploadConcurrency(), b.UploadFile)
+}
+
+func (b *S3Backend) DeleteBlobsWithPrefix(ctx context.Context, prefix string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// Forward listed objects to RemoveObjects, keeping listing errors for ourselves.
+	var listErr error
+	objects := make(chan minio.ObjectInfo)
+	go func() {
+		defer close(objects)
+		for obj := range b.client.ListObjects(ctx, b.bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+			if obj.Err != nil {
+				listErr = obj.Err
+				return
+			}
+			select {
+			case objects <- obj:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	for rerr := range b.client.RemoveObjects(ctx, b.bucket, objects, minio.RemoveObjectsOptions{}) {
+		if rerr.Err != nil {
+			return fmt.Errorf("failed to delete blob %s: %w", rerr.ObjectName, rerr.Err)
+		}
+	}
+	if listErr != nil {
+		return fmt.Errorf("failed to list blobs with prefix %s: %w", prefix, listErr)
+	}
+	return nil
+}
+
+func (b *S3Backend) BlobExists(ctx context.Context, blobPath string) (bool, error) {
+	_, err := b.client.StatObject(ctx, b.bucket, blobPath, minio.StatObjectOptions{})
+	if err == nil {
+		return true, nil
+	}
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return false, nil
+	}
+	return false, fmt.Errorf("failed to check blob existence: %w", err)
+}
+
+func (b *S3Backend) Size(ctx context.Context, blobPath string) (int64, error) {
+	info, err := b.client.StatObject(ctx, b.bucket, blobPath, minio.StatObjectOptions{})
+	if err != nil {
+		return 0, err
+	}
+	return info.Size, nil
+}
+
+func (b *S3Backend) ReadRange(ctx context.Context, blobPath string, offset, length int64) (io.ReadCloser, error) {
+	opts := minio.GetObjectOptions{}
+	if err := opts.SetRange(offset, offset+length-1); err != nil {
+		return nil, err
+	}
+	return b.client.GetObject(ctx, b.bucket, blobPath, opts)
+}
+
+// PublicURL uses S3_PUBLIC_BASE (e.g. a CDN) when set, otherwise a path-style URL.
+func (b *S3Backend) PublicURL(blobPath string) string {
+	if b.publicBase != "" {
+		return fmt.Sprintf("%s/%s", b.publicBase, blobPath)
+	}
+	scheme := "http"
+	if b.secure {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s/%s/%s", scheme, b.endpoint, b.bucket, blobPath)
+}
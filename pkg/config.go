@@ -0,0 +1,130 @@
+package pkg
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/streamhive/transcoder/internal/ffmpeg"
+	"github.com/streamhive/transcoder/internal/queue"
+)
+
+const (
+	// EncodeSinglePass decodes the source once and writes every rendition from one ffmpeg process.
+	EncodeSinglePass = "single-pass"
+	// EncodePerRendition runs one ffmpeg process per rendition.
+	EncodePerRendition = "per-rendition"
+)
+
+// Config holds pipeline settings read from the environment.
+type Config struct {
+	EncodeMode string
+	// InputMode is InputDownload or InputStream; streaming only applies to single-pass encodes.
+	InputMode string
+	// ThreadBudget is the number of ffmpeg threads shared by all jobs in this process.
+	ThreadBudget int
+	// ThreadsPerRendition is what each rendition's ffmpeg draws from ThreadBudget.
+	ThreadsPerRendition int
+	// ProgressRoutingKey is where throttled transcode progress events are published.
+	ProgressRoutingKey string
+	// MinDuration and MaxDuration bound the accepted source length in seconds; 0 disables.
+	MinDuration float64
+	MaxDuration float64
+	// AllowedContainers are ffprobe format names and AllowedVideoCodecs ffprobe codec
+	// names accepted as input. Empty lists allow everything.
+	AllowedContainers  []string
+	AllowedVideoCodecs []string
+	// FailedRoutingKey is where video.transcode.failed events are published.
+	FailedRoutingKey string
+	// ProgressInterval is the minimum gap between two progress events for one job.
+	ProgressInterval time.Duration
+	// GOPSeconds is the keyframe interval; SegmentSeconds, the HLS segment length, must be
+	// a multiple of it so every segment starts on a keyframe.
+	GOPSeconds     float64
+	SegmentSeconds int
+	// PerTitle tunes the per-title analysis run for ladders or events that ask for it.
+	PerTitle ffmpeg.AnalysisOptions
+	// Ladders are the named encoding ladders jobs can select, from TRANSCODER_LADDER_FILE
+	// or the built-in default.
+	Ladders ffmpeg.LadderSet
+}
+
+// ConfigFromEnv reads pipeline settings, falling back to defaults for unset values. It
+// fails when the ladder file cannot be loaded or is invalid.
+func ConfigFromEnv() (Config, error) {
+	cfg := Config{
+		EncodeMode:          EncodeSinglePass,
+		ThreadBudget:        queue.GetEnvInt("TRANSCODER_THREAD_BUDGET", runtime.NumCPU()),
+		ThreadsPerRendition: queue.GetEnvInt("TRANSCODER_THREADS_PER_RENDITION", 2),
+		ProgressRoutingKey:  getenv("AMQP_PROGRESS_ROUTING_KEY", "video.transcoding.progress"),
+		FailedRoutingKey:    getenv("AMQP_FAILED_ROUTING_KEY", "video.transcode.failed"),
+		ProgressInterval:    time.Duration(queue.GetEnvInt("TRANSCODER_PROGRESS_INTERVAL_MS", 2000)) * time.Millisecond,
+	}
+	if v := os.Getenv("TRANSCODER_ENCODE_MODE"); v == EncodePerRendition {
+		cfg.EncodeMode = v
+	}
+	cfg.MinDuration = float64(queue.GetEnvInt("TRANSCODER_MIN_DURATION_SEC", 1))
+	cfg.MaxDuration = float64(queue.GetEnvInt("TRANSCODER_MAX_DURATION_SEC", 4*60*60))
+	cfg.AllowedContainers = splitList(getenv("TRANSCODER_ALLOWED_CONTAINERS", "mov,mp4,m4a,3gp,3g2,mj2,matroska,webm,avi,mpegts,flv,mpeg,ogg,asf"))
+	cfg.AllowedVideoCodecs = splitList(getenv("TRANSCODER_ALLOWED_VIDEO_CODECS", "h264,hevc,vp8,vp9,av1,mpeg4,mpeg2video,mpeg1video,prores,mjpeg,h263,theora,wmv3,vc1"))
+	cfg.InputMode = InputDownload
+	if v := os.Getenv("TRANSCODER_INPUT_MODE"); v == InputStream {
+		cfg.InputMode = v
+	}
+	if cfg.ThreadBudget < 1 {
+		cfg.ThreadBudget = 1
+	}
+	if cfg.ThreadsPerRendition < 1 || cfg.ThreadsPerRendition > cfg.ThreadBudget {
+		cfg.ThreadsPerRendition = cfg.ThreadBudget
+	}
+	cfg.SegmentSeconds = queue.GetEnvInt("TRANSCODER_SEGMENT_SECONDS", 6)
+	gop, err := strconv.ParseFloat(getenv("TRANSCODER_GOP_SECONDS", "2"), 64)
+	if err != nil || gop <= 0 {
+		return cfg, fmt.Errorf("TRANSCODER_GOP_SECONDS: must be a positive number")
+	}
+	cfg.GOPSeconds = gop
+	if n := float64(cfg.SegmentSeconds) / gop; cfg.SegmentSeconds < 1 || math.Abs(n-math.Round(n)) > 1e-9 {
+		return cfg, fmt.Errorf("TRANSCODER_SEGMENT_SECONDS (%d) must be a positive multiple of TRANSCODER_GOP_SECONDS (%v)", cfg.SegmentSeconds, gop)
+	}
+	cfg.PerTitle = ffmpeg.AnalysisOptions{
+		Samples:       queue.GetEnvInt("TRANSCODER_PER_TITLE_SAMPLES", 4),
+		SampleSeconds: float64(queue.GetEnvInt("TRANSCODER_PER_TITLE_SAMPLE_SEC", 4)),
+		CRF:           queue.GetEnvInt("TRANSCODER_PER_TITLE_CRF", 23),
+		MinScale:      float64(queue.GetEnvInt("TRANSCODER_PER_TITLE_MIN_SCALE_PCT", 50)) / 100,
+		MaxScale:      float64(queue.GetEnvInt("TRANSCODER_PER_TITLE_MAX_SCALE_PCT", 130)) / 100,
+		Threads:       cfg.ThreadsPerRendition,
+	}
+	if pt := cfg.PerTitle; pt.SampleSeconds <= 0 || pt.MinScale <= 0 || pt.MaxScale < pt.MinScale {
+		return cfg, fmt.Errorf("per-title settings: need a positive sample length and 0 < min scale <= max scale")
+	}
+	cfg.Ladders = ffmpeg.DefaultLadders
+	if path := os.Getenv("TRANSCODER_LADDER_FILE"); path != "" {
+		ladders, err := ffmpeg.LoadLadders(path)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.Ladders = ladders
+	}
+	return cfg, nil
+}
+
+func getenv(k, def string) string {
+	if v := os.Getenv(k); v != "" {
+		return v
+	}
+	return def
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
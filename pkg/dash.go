@@ -0,0 +1,213 @@
+package pkg
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+
+	"github.com/streamhive/transcoder/internal/ffmpeg"
+)
+
+// dashManifest is the MPD written next to master.m3u8 for jobs with DASH enabled.
+const dashManifest = "manifest.mpd"
+
+type mpd struct {
+	XMLName                   xml.Name  `xml:"urn:mpeg:dash:schema:mpd:2011 MPD"`
+	Profiles                  string    `xml:"profiles,attr"`
+	Type                      string    `xml:"type,attr"`
+	MediaPresentationDuration string    `xml:"mediaPresentationDuration,attr"`
+	MinBufferTime             string    `xml:"minBufferTime,attr"`
+	Period                    mpdPeriod `xml:"Period"`
+}
+
+type mpdPeriod struct {
+	ID             string             `xml:"id,attr"`
+	Start          string             `xml:"start,attr"`
+	AdaptationSets []mpdAdaptationSet `xml:"AdaptationSet"`
+}
+
+type mpdAdaptationSet struct {
+	ID               int                 `xml:"id,attr"`
+	ContentType      string              `xml:"contentType,attr"`
+	MimeType         string              `xml:"mimeType,attr"`
+	SegmentAlignment bool                `xml:"segmentAlignment,attr"`
+	StartWithSAP     int                 `xml:"startWithSAP,attr"`
+	Representations  []mpdRepresentation `xml:"Representation"`
+}
+
+type mpdRepresentation struct {
+	ID                string             `xml:"id,attr"`
+	Bandwidth         int                `xml:"bandwidth,attr"`
+	Width             int                `xml:"width,attr,omitempty"`
+	Height            int                `xml:"height,attr,omitempty"`
+	FrameRate         string             `xml:"frameRate,attr,omitempty"`
+	AudioSamplingRate int                `xml:"audioSamplingRate,attr,omitempty"`
+	Codecs            string             `xml:"codecs,attr,omitempty"`
+	SegmentTemplate   mpdSegmentTemplate `xml:"SegmentTemplate"`
+}
+
+type mpdSegmentTemplate struct {
+	Timescale      int        `xml:"timescale,attr"`
+	Initialization string     `xml:"initialization,attr"`
+	Media          string     `xml:"media,attr"`
+	StartNumber    int        `xml:"startNumber,attr"`
+	Timeline       []mpdEntry `xml:"SegmentTimeline>S"`
+}
+
+type mpdEntry struct {
+	T int64 `xml:"t,attr,omitempty"`
+	D int64 `xml:"d,attr"`
+	R int   `xml:"r,attr,omitempty"`
+}
+
+// dashTimescale is the MPD time unit per second; HLS durations carry millisecond precision.
+const dashTimescale = 1000
+
+// writeDASH builds the MPD from the renditions' fMP4 media playlists and uploads it. The
+// MPD addresses the HLS init and .m4s segments directly, so nothing is stored twice.
+// Playlists of renditions finished by an earlier attempt are fetched from storage.
+func (t *Transcoder) writeDASH(ctx context.Context, j *job, ladder []ffmpeg.Rung) error {
+	renditions := rungNames(ladder)
+	if j.audioKbps > 0 {
+		renditions = append(renditions, ffmpeg.AudioRendition)
+	}
+	segs := make(map[string][]ffmpeg.MediaSegment, len(renditions))
+	for _, res := range renditions {
+		local := filepath.Join(j.outRoot, res, "index.m3u8")
+		if _, err := os.Stat(local); os.IsNotExist(err) {
+			if err := os.MkdirAll(filepath.Dir(local), 0o755); err != nil {
+				return err
+			}
+			if err := t.store.DownloadTo(ctx, j.base+"/"+res+"/index.m3u8", local); err != nil {
+				return stageError(StageDownload, fmt.Errorf("playlist %s: %w", res, err))
+			}
+		}
+		s, err := ffmpeg.ReadMediaPlaylist(local)
+		if err != nil {
+			return err
+		}
+		segs[res] = s
+	}
+	b, err := t.buildMPD(j, ladder, segs)
+	if err != nil {
+		return stageError(StageEncode, fmt.Errorf("dash: %w", err))
+	}
+	path := filepath.Join(j.outRoot, dashManifest)
+	if err := os.WriteFile(path, b, 0o644); err != nil {
+		return err
+	}
+	if err := t.store.UploadFile(ctx, path, j.base+"/"+dashManifest, "application/dash+xml"); err != nil {
+		return stageError(StageUpload, fmt.Errorf("upload dash manifest: %w", err))
+	}
+	return nil
+}
+
+// buildMPD writes a static, live-profile MPD with one representation per rendition and one
+// video adaptation set per codec family, since players cannot switch codecs within a set.
+// The separate audio rendition, if any, gets an audio adaptation set of its own.
+func (t *Transcoder) buildMPD(j *job, ladder []ffmpeg.Rung, segs map[string][]ffmpeg.MediaSegment) ([]byte, error) {
+	var sets []mpdAdaptationSet
+	setIdx := map[string]int{}
+	var total float64
+	for _, r := range ladder {
+		i, ok := setIdx[r.VideoCodec()]
+		if !ok {
+			i = len(sets)
+			setIdx[r.VideoCodec()] = i
+			sets = append(sets, mpdAdaptationSet{ID: i, ContentType: "video", MimeType: "video/mp4", SegmentAlignment: true, StartWithSAP: 1})
+		}
+		rep := mpdRepresentation{ID: r.ID(), Bandwidth: r.Bandwidth()}
+		if v := j.state.variant(r.ID()); v != nil {
+			rep.Bandwidth, rep.Width, rep.Height, rep.Codecs = v.Bandwidth, v.Width, v.Height, v.Codecs
+			rep.FrameRate = dashFrameRate(v.FrameRate)
+		}
+		timeline, dur, err := dashTimeline(segs[r.ID()])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", r.ID(), err)
+		}
+		total = max(total, dur)
+		rep.SegmentTemplate = mpdSegmentTemplate{
+			Timescale:      dashTimescale,
+			Initialization: r.ID() + "/" + ffmpeg.InitSegment,
+			Media:          r.ID() + "/index$Number$.m4s",
+			Timeline:       timeline,
+		}
+		sets[i].Representations = append(sets[i].Representations, rep)
+	}
+	if j.audioKbps > 0 {
+		res := ffmpeg.AudioRendition
+		rep := mpdRepresentation{ID: res, Bandwidth: j.audioKbps * 1000, AudioSamplingRate: 48000}
+		if v := j.state.variant(res); v != nil {
+			rep.Bandwidth, rep.Codecs = v.Bandwidth, v.Codecs
+		}
+		timeline, dur, err := dashTimeline(segs[res])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", res, err)
+		}
+		total = max(total, dur)
+		rep.SegmentTemplate = mpdSegmentTemplate{
+			Timescale:      dashTimescale,
+			Initialization: res + "/" + ffmpeg.InitSegment,
+			Media:          res + "/index$Number$.m4s",
+			Timeline:       timeline,
+		}
+		sets = append(sets, mpdAdaptationSet{ID: len(sets), ContentType: "audio", MimeType: "audio/mp4", SegmentAlignment: true, StartWithSAP: 1,
+			Representations: []mpdRepresentation{rep}})
+	}
+	m := mpd{
+		Profiles:                  "urn:mpeg:dash:profile:isoff-live:2011",
+		Type:                      "static",
+		MediaPresentationDuration: fmt.Sprintf("PT%.3fS", total),
+		MinBufferTime:             fmt.Sprintf("PT%gS", 2*t.cfg.GOPSeconds),
+		Period:                    mpdPeriod{ID: "0", Start: "PT0S", AdaptationSets: sets},
+	}
+	b, err := xml.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), append(b, '\n')...), nil
+}
+
+// dashTimeline converts playlist durations to a run-length encoded SegmentTimeline. Start
+// times are rounded once from the running total so rounding never accumulates. Segments
+// must be the index<N>.m4s files the encoder writes, numbered from 0.
+func dashTimeline(segs []ffmpeg.MediaSegment) ([]mpdEntry, float64, error) {
+	if len(segs) == 0 {
+		return nil, 0, fmt.Errorf("no segments")
+	}
+	var entries []mpdEntry
+	var elapsed float64
+	var start int64
+	for i, s := range segs {
+		if want := fmt.Sprintf("index%d.m4s", i); s.URI != want {
+			return nil, 0, fmt.Errorf("segment %d is %q, want %q", i, s.URI, want)
+		}
+		elapsed += s.Duration
+		end := int64(math.Round(elapsed * dashTimescale))
+		d := end - start
+		if n := len(entries); n > 0 && entries[n-1].D == d {
+			entries[n-1].R++
+		} else {
+			entries = append(entries, mpdEntry{D: d})
+		}
+		start = end
+	}
+	return entries, elapsed, nil
+}
+
+// dashFrameRate formats fps as the integer or fraction an MPD frameRate allows.
+func dashFrameRate(fps float64) string {
+	switch {
+	case fps <= 0:
+		return ""
+	case math.Abs(fps-math.Round(fps)) < 1e-3:
+		return fmt.Sprintf("%d", int(math.Round(fps)))
+	case math.Abs(fps*1.001-math.Round(fps*1.001)) < 1e-3:
+		return fmt.Sprintf("%d/1001", int(math.Round(fps*1.001))*1000)
+	default:
+		return fmt.Sprintf("%d/1000", int(math.Round(fps*1000)))
+	}
+}
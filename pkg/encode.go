@@ -0,0 +1,163 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/streamhive/transcoder/internal/ffmpeg"
+)
+
+// encode writes one HLS variant per ladder rung under outRoot/<rung ID>/, plus the
+// separate audio rendition when audio is set, and calls done for each rendition as soon
+// as it is complete.
+func (t *Transcoder) encode(ctx context.Context, j *job, ladder []ffmpeg.Rung, audio bool, done func(ctx context.Context, res string) error) error {
+	names := rungNames(ladder)
+	if audio {
+		names = append(names, ffmpeg.AudioRendition)
+	}
+	for _, res := range names {
+		if err := os.MkdirAll(filepath.Join(j.outRoot, res), 0o755); err != nil {
+			return err
+		}
+	}
+	if j.encodeMode == EncodePerRendition || len(ladder) == 0 {
+		// Two-pass rungs run a first pass process too.
+		procs := len(names)
+		for _, r := range ladder {
+			if r.TwoPass() {
+				procs++
+			}
+		}
+		rep := t.newProgressReporter(ctx, j.evt, procs)
+		return t.encodePerRendition(ctx, j, rep, ladder, audio, done)
+	}
+	rep := t.newProgressReporter(ctx, j.evt, 1)
+	return t.encodeSinglePass(ctx, j, rep, ladder, audio, done)
+}
+
+func (t *Transcoder) encodeSinglePass(ctx context.Context, j *job, rep *progressReporter, ladder []ffmpeg.Rung, audio bool, done func(ctx context.Context, res string) error) error {
+	threads := t.cfg.ThreadsPerRendition * len(ladder)
+	if threads > t.cfg.ThreadBudget {
+		threads = t.cfg.ThreadBudget
+	}
+	if err := t.threads.Acquire(ctx, int64(threads)); err != nil {
+		return err
+	}
+	opts := t.encodeOptions(j, threads)
+	audioKbps := 0
+	names := rungNames(ladder)
+	if audio {
+		audioKbps = j.audioKbps
+		names = append(names, ffmpeg.AudioRendition)
+	}
+	cmd := ffmpeg.BuildHLSLadderCommand(ctx, j.inputPath, j.outRoot, ladder, audioKbps, opts)
+	start := time.Now()
+	err := t.runFFmpeg(ctx, cmd, rep, "ladder", j.probe.Duration)
+	t.threads.Release(int64(threads))
+	if err == nil {
+		err = ffmpeg.FinishLadder(j.outRoot, names, opts)
+	}
+	if err != nil {
+		return stageError(StageEncode+":"+strings.Join(names, ","), fmt.Errorf("ffmpeg ladder: %w", err))
+	}
+	t.log.Infow("ladder done", "mode", EncodeSinglePass, "renditions", names, "threads", threads, "ms", time.Since(start).Milliseconds())
+	for _, res := range names {
+		if err := done(ctx, res); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodePerRendition runs the renditions concurrently, each holding ThreadsPerRendition
+// threads from the shared budget. The first failure cancels the remaining encodes.
+func (t *Transcoder) encodePerRendition(ctx context.Context, j *job, rep *progressReporter, ladder []ffmpeg.Rung, audio bool, done func(ctx context.Context, res string) error) error {
+	start := time.Now()
+	threads := t.cfg.ThreadsPerRendition
+	g, gctx := errgroup.WithContext(ctx)
+	if audio {
+		g.Go(func() error {
+			res := ffmpeg.AudioRendition
+			// Audio encoding is light; one thread keeps it out of the video budget's way.
+			if err := t.threads.Acquire(gctx, 1); err != nil {
+				return err
+			}
+			opts := t.encodeOptions(j, 1)
+			resStart := time.Now()
+			cmd := ffmpeg.BuildHLSAudioCommand(gctx, j.inputPath, filepath.Join(j.outRoot, res), j.audioKbps, opts)
+			err := t.runFFmpeg(gctx, cmd, rep, res, j.probe.Duration)
+			t.threads.Release(1)
+			if err != nil {
+				return stageError(StageEncode+":"+res, fmt.Errorf("ffmpeg %s: %w", res, err))
+			}
+			t.log.Infow("rendition done", "res", res, "threads", 1, "ms", time.Since(resStart).Milliseconds())
+			return done(gctx, res)
+		})
+	}
+	for _, r := range ladder {
+		r, res := r, r.ID()
+		g.Go(func() error {
+			if err := t.threads.Acquire(gctx, int64(threads)); err != nil {
+				return err
+			}
+			opts := t.encodeOptions(j, threads)
+			resStart := time.Now()
+			var err error
+			if r.TwoPass() {
+				// Stats stay in the work dir, which is removed with the job.
+				opts.PassLogFile = filepath.Join(j.work, "passlog-"+res)
+				cmd := ffmpeg.BuildFirstPassCommand(gctx, j.inputPath, r, opts)
+				err = t.runFFmpeg(gctx, cmd, rep, res+"/pass1", j.probe.Duration)
+			}
+			if err == nil {
+				cmd := ffmpeg.BuildHLSCommand(gctx, j.inputPath, filepath.Join(j.outRoot, res), r, opts)
+				err = t.runFFmpeg(gctx, cmd, rep, res, j.probe.Duration)
+			}
+			t.threads.Release(int64(threads))
+			if err != nil {
+				return stageError(StageEncode+":"+res, fmt.Errorf("ffmpeg %s: %w", res, err))
+			}
+			t.log.Infow("rendition done", "res", res, "threads", threads, "ms", time.Since(resStart).Milliseconds())
+			return done(gctx, res)
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+	names := rungNames(ladder)
+	if audio {
+		names = append(names, ffmpeg.AudioRendition)
+	}
+	t.log.Infow("ladder done", "mode", EncodePerRendition, "renditions", names, "ms", time.Since(start).Milliseconds())
+	return nil
+}
+
+// encodeOptions derives the ffmpeg options for this job's source.
+func (t *Transcoder) encodeOptions(j *job, threads int) ffmpeg.EncodeOptions {
+	return ffmpeg.EncodeOptions{
+		Threads:           threads,
+		HasAudio:          j.probe.AudioCodec != "",
+		Portrait:          j.probe.Portrait(),
+		FrameRate:         j.probe.OutputFrameRate(),
+		ConstantFrameRate: j.probe.VariableFrameRate,
+		GOPSeconds:        t.cfg.GOPSeconds,
+		SegmentSeconds:    t.cfg.SegmentSeconds,
+		SegmentType:       j.segType,
+		SeparateAudio:     j.audioKbps > 0,
+	}
+}
+
+// rungNames returns the rendition IDs of ladder, e.g. "720p" or "720p-hevc".
+func rungNames(ladder []ffmpeg.Rung) []string {
+	names := make([]string, len(ladder))
+	for i, r := range ladder {
+		names[i] = r.ID()
+	}
+	return names
+}
@@ -0,0 +1,145 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/streamhive/transcoder/internal/ffmpeg"
+	"github.com/streamhive/transcoder/internal/queue"
+)
+
+// Pipeline stages reported in video.transcode.failed. Encode failures use "encode:<res>".
+const (
+	StageValidate  = "validate"
+	StageDownload  = "download"
+	StageProbe     = "probe"
+	StageEncode    = "encode"
+	StageUpload    = "upload"
+	StageThumbnail = "thumbnail"
+	StagePublish   = "publish"
+)
+
+// Error classes reported in video.transcode.failed.
+const (
+	ClassInvalidEvent       = "invalid_event"
+	ClassInvalidInput       = "invalid_input"
+	ClassCorruptInput       = "corrupt_input"
+	ClassUnsupportedCodec   = "unsupported_codec"
+	ClassStorageUnavailable = "storage_unavailable"
+	ClassTimeout            = "timeout"
+	ClassUnknown            = "unknown"
+)
+
+// stderrTailBytes is how much ffmpeg stderr is kept for failure events.
+const stderrTailBytes = 4096
+
+// JobError describes why a job failed and whether retrying it can help.
+type JobError struct {
+	Stage      string
+	Class      string
+	StderrTail string
+	Err        error
+
+	retryable bool
+}
+
+func (e *JobError) Error() string { return fmt.Sprintf("%s: %v", e.Stage, e.Err) }
+
+func (e *JobError) Unwrap() error { return e.Err }
+
+// Retryable reports whether the same message may succeed on another attempt.
+func (e *JobError) Retryable() bool { return e.retryable }
+
+var (
+	corruptInputMarkers = []string{
+		"invalid data found when processing input",
+		"moov atom not found",
+		"invalid nal unit",
+	}
+	unsupportedCodecMarkers = []string{
+		"decoder not found",
+		"unknown decoder",
+		"codec not currently supported",
+		"unsupported codec",
+		"could not find codec parameters",
+	}
+)
+
+// stageError wraps err with its stage and classifies it from the error chain and any
+// ffmpeg stderr it carries. Errors already classified are returned unchanged.
+func stageError(stage string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var je *JobError
+	if errors.As(err, &je) {
+		return err
+	}
+	je = &JobError{Stage: stage, Err: err}
+	var ce *ffmpeg.CommandError
+	if errors.As(err, &ce) {
+		je.StderrTail = ce.Stderr
+	}
+	stderr := strings.ToLower(je.StderrTail)
+
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		je.Class, je.retryable = ClassTimeout, true
+	case errors.Is(err, ffmpeg.ErrNoVideoStream), containsAny(stderr, corruptInputMarkers):
+		je.Class = ClassCorruptInput
+	case containsAny(stderr, unsupportedCodecMarkers):
+		je.Class = ClassUnsupportedCodec
+	case stage == StageDownload || stage == StageUpload || stage == StageThumbnail:
+		je.Class, je.retryable = ClassStorageUnavailable, true
+	case stage == StageValidate:
+		je.Class = ClassInvalidEvent
+	default:
+		je.Class, je.retryable = ClassUnknown, true
+	}
+	return je
+}
+
+// failedAt reports whether err is a JobError from stage.
+func failedAt(err error, stage string) bool {
+	var je *JobError
+	return errors.As(err, &je) && je.Stage == stage
+}
+
+func containsAny(s string, subs []string) bool {
+	for _, sub := range subs {
+		if strings.Contains(s, sub) {
+			return true
+		}
+	}
+	return false
+}
+
+// publishFailure tells downstream services the job failed so the video does not stay
+// "processing" forever.
+func (t *Transcoder) publishFailure(ctx context.Context, evt *UploadEvent, err error) {
+	var je *JobError
+	if !errors.As(err, &je) {
+		je = stageError("unknown", err).(*JobError)
+	}
+	out := map[string]any{
+		"uploadId":   evt.UploadID,
+		"userId":     evt.UserID,
+		"stage":      je.Stage,
+		"errorClass": je.Class,
+		"error":      je.Err.Error(),
+		"stderrTail": je.StderrTail,
+		"retryable":  je.retryable,
+	}
+	// final tells the catalog no further attempt will follow this one.
+	if attempt, max := queue.DeliveryAttempt(ctx); attempt > 0 {
+		out["attempt"] = attempt
+		out["maxAttempts"] = max
+		out["final"] = !queue.WillRetry(ctx, je)
+	}
+	// The job context may already be cancelled; the failure still needs to go out.
+	if perr := t.pub.PublishJSONTo(context.WithoutCancel(ctx), t.cfg.FailedRoutingKey, out); perr != nil {
+		t.log.Errorw("failure event publish failed", "uploadId", evt.UploadID, "err", perr)
+	}
+}
@@ -0,0 +1,126 @@
+package pkg
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/streamhive/transcoder/internal/storage"
+)
+
+const (
+	// InputDownload copies the whole source into the work dir before encoding.
+	InputDownload = "download"
+	// InputStream lets ffmpeg read the source over HTTP range requests.
+	InputStream = "stream"
+)
+
+// streamableExts are containers ffmpeg can decode front to back without seeking.
+// MP4-family files qualify only when their moov atom precedes the media data.
+var streamableExts = map[string]bool{
+	".mkv": true, ".webm": true, ".ts": true, ".m2ts": true, ".mpg": true, ".mpeg": true, ".flv": true,
+}
+
+var mp4Exts = map[string]bool{".mp4": true, ".m4v": true, ".mov": true}
+
+// openInput makes the source available to ffmpeg and sets j.inputPath, which is either a
+// local file or a loopback URL. The returned func releases whatever was set up.
+func (t *Transcoder) openInput(ctx context.Context, j *job) (func(), error) {
+	noop := func() {}
+	if t.cfg.InputMode == InputStream {
+		ok, reason := t.canStream(ctx, j)
+		if ok {
+			proxy, err := storage.ServeBlob(ctx, t.store, j.evt.RawVideoPath)
+			if err != nil {
+				return noop, stageError(StageDownload, err)
+			}
+			j.inputPath, j.streamed = proxy.URL, true
+			t.log.Infow("streaming source", "uploadId", j.evt.UploadID)
+			return func() { _ = proxy.Close() }, nil
+		}
+		t.log.Infow("source not streamable, downloading", "uploadId", j.evt.UploadID, "reason", reason)
+	}
+
+	j.inputPath = filepath.Join(j.work, "input"+inputExt(j.evt))
+	if err := t.store.DownloadTo(ctx, j.evt.RawVideoPath, j.inputPath); err != nil {
+		return noop, stageError(StageDownload, err)
+	}
+	return noop, nil
+}
+
+// canStream reports whether the source can be decoded without random access, and why not.
+func (t *Transcoder) canStream(ctx context.Context, j *job) (bool, string) {
+	blobPath := j.evt.RawVideoPath
+	if j.encodeMode != EncodeSinglePass {
+		// Each rendition process would fetch the whole source again.
+		return false, "per-rendition encoding reads the source once per rendition"
+	}
+	ext := strings.ToLower(path.Ext(blobPath))
+	if streamableExts[ext] {
+		return true, ""
+	}
+	if !mp4Exts[ext] {
+		return false, fmt.Sprintf("container %q may need seeking", ext)
+	}
+	first, err := moovFirst(ctx, t.store, blobPath)
+	if err != nil {
+		return false, err.Error()
+	}
+	if !first {
+		return false, "moov atom is at the end of the file"
+	}
+	return true, ""
+}
+
+// moovFirst walks the top-level MP4 boxes with small ranged reads and reports whether the
+// moov box comes before mdat.
+func moovFirst(ctx context.Context, store storage.Backend, blobPath string) (bool, error) {
+	size, err := store.Size(ctx, blobPath)
+	if err != nil {
+		return false, err
+	}
+	for off := int64(0); off+8 <= size; {
+		hdr, err := readRange(ctx, store, blobPath, off, min(16, size-off))
+		if err != nil {
+			return false, err
+		}
+		boxSize := int64(binary.BigEndian.Uint32(hdr[0:4]))
+		switch boxType := string(hdr[4:8]); boxType {
+		case "moov":
+			return true, nil
+		case "mdat":
+			return false, nil
+		}
+		switch boxSize {
+		case 0: // box runs to the end of the file
+			return false, nil
+		case 1: // 64-bit size follows the type
+			if len(hdr) < 16 {
+				return false, fmt.Errorf("truncated box header at %d", off)
+			}
+			boxSize = int64(binary.BigEndian.Uint64(hdr[8:16]))
+		}
+		if boxSize < 8 {
+			return false, fmt.Errorf("invalid box size %d at %d", boxSize, off)
+		}
+		off += boxSize
+	}
+	return false, nil
+}
+
+func readRange(ctx context.Context, store storage.Backend, blobPath string, off, n int64) ([]byte, error) {
+	rc, err := store.ReadRange(ctx, blobPath, off, n)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(rc, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
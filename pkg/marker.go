@@ -0,0 +1,66 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// successMarker is written under the HLS prefix once every output is uploaded. It holds
+// the transcoded event so a redelivered message can be answered without redoing the job.
+const successMarker = "_SUCCESS"
+
+// republishIfDone looks for the completion marker of a previous run and, when present,
+// republishes its transcoded event. It reports whether the job can be skipped. Marker
+// lookup problems are logged and treated as "not done" so the job runs normally.
+func (t *Transcoder) republishIfDone(ctx context.Context, evt *UploadEvent, base, work string) (bool, error) {
+	markerBlob := fmt.Sprintf("%s/%s", base, successMarker)
+	exists, err := t.store.BlobExists(ctx, markerBlob)
+	if err != nil {
+		t.log.Warnw("completion marker check failed, transcoding", "uploadId", evt.UploadID, "err", err)
+		return false, nil
+	}
+	if !exists {
+		return false, nil
+	}
+	local := filepath.Join(work, successMarker)
+	if err := t.store.DownloadTo(ctx, markerBlob, local); err != nil {
+		t.log.Warnw("completion marker download failed, transcoding", "uploadId", evt.UploadID, "err", err)
+		return false, nil
+	}
+	var out map[string]any
+	b, err := os.ReadFile(local)
+	if err == nil {
+		err = json.Unmarshal(b, &out)
+	}
+	if err != nil {
+		t.log.Warnw("completion marker unreadable, transcoding", "uploadId", evt.UploadID, "err", err)
+		return false, nil
+	}
+	t.log.Infow("upload already transcoded, republishing", "uploadId", evt.UploadID)
+	return true, stageError(StagePublish, t.pub.PublishJSON(ctx, out))
+}
+
+// writeSuccessMarker uploads the transcoded event as the job's completion marker.
+func (t *Transcoder) writeSuccessMarker(ctx context.Context, out map[string]any, base, work string) error {
+	b, err := json.Marshal(out)
+	if err != nil {
+		return err
+	}
+	local := filepath.Join(work, successMarker)
+	if err := os.WriteFile(local, b, 0o644); err != nil {
+		return err
+	}
+	return t.store.UploadFile(ctx, local, fmt.Sprintf("%s/%s", base, successMarker), "application/json")
+}
+
+// resetJob removes the completion marker and saved job state of earlier runs, so a forced
+// run neither republishes nor resumes from them.
+func (t *Transcoder) resetJob(ctx context.Context, evt *UploadEvent, base string) error {
+	if err := t.store.DeleteBlobsWithPrefix(ctx, fmt.Sprintf("%s/%s", base, successMarker)); err != nil {
+		return err
+	}
+	return t.states.Clear(ctx, evt)
+}
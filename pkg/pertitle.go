@@ -0,0 +1,65 @@
+package pkg
+
+import (
+	"context"
+	"time"
+
+	"github.com/streamhive/transcoder/internal/ffmpeg"
+)
+
+// perTitle analyses the source's complexity and adapts the ladder to it. A previous
+// attempt's result is reused from the job state. Analysis failures only cost the
+// optimisation: the ladder is returned unchanged and c is nil.
+func (t *Transcoder) perTitle(ctx context.Context, j *job, ladder []ffmpeg.Rung) (kept, pruned []ffmpeg.Rung, c *ffmpeg.Complexity, err error) {
+	c = j.state.complexity()
+	if c == nil {
+		ref, ok := ffmpeg.ReferenceRung(ladder)
+		if !ok {
+			return ladder, nil, nil, nil
+		}
+		opts := t.cfg.PerTitle
+		opts.Portrait = j.probe.Portrait()
+		if err := t.threads.Acquire(ctx, int64(opts.Threads)); err != nil {
+			return nil, nil, nil, err
+		}
+		start := time.Now()
+		c, err = ffmpeg.AnalyzeComplexity(ctx, j.inputPath, j.work, j.probe.Duration, ref, opts)
+		t.threads.Release(int64(opts.Threads))
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, nil, nil, ctx.Err()
+			}
+			t.log.Warnw("per-title analysis failed, using the configured ladder", "uploadId", j.evt.UploadID, "err", err)
+			return ladder, nil, nil, nil
+		}
+		t.log.Infow("per-title analysis done", "uploadId", j.evt.UploadID, "score", c.Score, "scale", c.Scale,
+			"sampleKbps", c.SampleKbps, "ms", time.Since(start).Milliseconds())
+		j.state.setComplexity(c)
+	}
+	kept, pruned = ffmpeg.ApplyComplexity(ladder, c)
+	if len(pruned) > 0 {
+		t.log.Infow("per-title pruned renditions", "uploadId", j.evt.UploadID, "pruned", rungNames(pruned))
+	}
+	return kept, pruned, c, nil
+}
+
+// perTitleEvent describes the analysis and the ladder it produced for the transcoded event.
+func perTitleEvent(c *ffmpeg.Complexity, ladder, pruned []ffmpeg.Rung) map[string]any {
+	rungs := make([]map[string]any, len(ladder))
+	for i, r := range ladder {
+		rungs[i] = map[string]any{
+			"id":           r.ID(),
+			"height":       r.Height,
+			"videoBitrate": r.VideoBitrate,
+			"maxrate":      r.MaxRate,
+			"bufsize":      r.BufSize,
+		}
+	}
+	return map[string]any{
+		"complexity": c.Score,
+		"scale":      c.Scale,
+		"sampleKbps": c.SampleKbps,
+		"ladder":     rungs,
+		"pruned":     rungNames(pruned),
+	}
+}
@@ -7,10 +7,13 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 
 	"go.uber.org/zap"
+	"golang.org/x/sync/semaphore"
 
 	"github.com/streamhive/transcoder/internal/ffmpeg"
 	"github.com/streamhive/transcoder/internal/queue"
@@ -31,116 +34,221 @@ type UploadEvent struct {
 	ContainerName string   `json:"containerName"`
 	BlobURL       string   `json:"blobUrl"`
 	Resolutions   []string `json:"resolutions"`
+	// Ladder names the encoding ladder to use; empty selects "default". Resolutions, when
+	// set, picks rungs from it by name.
+	Ladder string `json:"ladder"`
+	// SegmentType overrides the ladder's HLS segment container: "mpegts" or "fmp4".
+	SegmentType string `json:"segmentType"`
+	// DASH also writes a DASH manifest over the fMP4 renditions, as does a ladder with dash set.
+	DASH bool `json:"dash"`
+	// PerTitle adapts the ladder bitrates to the source's complexity, as does a ladder with
+	// perTitle set.
+	PerTitle bool `json:"perTitle"`
+	// Force re-transcodes even if a previous run already completed this upload.
+	Force bool `json:"force"`
 }
 
 type Transcoder struct {
-	log *zap.SugaredLogger
-	az  *storage.AzureClient
-	pub *queue.Publisher
-}
+	log    *zap.SugaredLogger
+	store  storage.Backend
+	pub    *queue.Publisher
+	states JobStateStore
+	cfg    Config
 
-func NewTranscoder(log *zap.SugaredLogger, az *storage.AzureClient, pub *queue.Publisher) *Transcoder {
-	return &Transcoder{log: log, az: az, pub: pub}
+	// threads is the ffmpeg thread budget shared by every job running in this process.
+	threads *semaphore.Weighted
 }
 
-// buildAzureURL constructs the full Azure Blob Storage URL for a given blob path
-func (t *Transcoder) buildAzureURL(blobPath string) string {
-	// Get Azure account name and container from secrets or environment
-	account := getSecret("/mnt/secrets-store/azure-storage-account", "AZURE_STORAGE_ACCOUNT")
-	container := getSecret("/mnt/secrets-store/azure-storage-raw-container", "AZURE_BLOB_CONTAINER")
-
-	if container == "" {
-		container = "uploadservicecontainer" // fallback
-	}
-
-	if account == "" {
-		// Fallback to environment variable approach for backwards compatibility
-		baseURL := os.Getenv("AZURE_PUBLIC_BASE")
-		if baseURL != "" {
-			return fmt.Sprintf("%s/%s", baseURL, blobPath)
-		}
-		// Last resort: return relative path (this was the original problem)
-		t.log.Warnw("Azure account not found, returning relative URL", "blobPath", blobPath)
-		return fmt.Sprintf("/%s", blobPath)
-	}
-
-	return fmt.Sprintf("https://%s.blob.core.windows.net/%s/%s", account, container, blobPath)
+func NewTranscoder(log *zap.SugaredLogger, store storage.Backend, pub *queue.Publisher, states JobStateStore, cfg Config) *Transcoder {
+	return &Transcoder{log: log, store: store, pub: pub, states: states, cfg: cfg, threads: semaphore.NewWeighted(int64(cfg.ThreadBudget))}
 }
 
-// Helper function to read secret from file or fallback to environment variable
-func getSecret(filePath, envVar string) string {
-	if data, err := os.ReadFile(filePath); err == nil {
-		return strings.TrimSpace(string(data))
-	}
-	return os.Getenv(envVar)
+// job carries the per-upload values threaded through the pipeline stages.
+type job struct {
+	evt       *UploadEvent
+	work      string // local scratch directory, removed when the job ends
+	inputPath string
+	streamed  bool   // inputPath is the range proxy URL rather than a downloaded copy
+	outRoot   string // local HLS tree, one directory per rendition
+	base      string // blob prefix of the HLS outputs
+	probe     *ffmpeg.ProbeResult
+	segType   string // ffmpeg.SegmentMPEGTS or ffmpeg.SegmentFMP4
+	dash      bool   // write a DASH manifest; implies fMP4 segments
+	// audioKbps is the bitrate of the separate audio rendition of DASH jobs with audio;
+	// 0 when audio is muxed into every variant.
+	audioKbps int
+	perTitle  bool // run the per-title analysis before encoding
+	// encodeMode is Config.EncodeMode unless the ladder needs per-rendition encoding.
+	encodeMode string
+	state      *JobState
+	saveMu     sync.Mutex // orders state saves from concurrently finishing renditions
 }
 
 func (t *Transcoder) Handle(ctx context.Context, body []byte) error {
+	defer resetProgress(ctx)
 	var evt UploadEvent
 	if err := json.Unmarshal(body, &evt); err != nil {
-		return fmt.Errorf("json: %w", err)
+		return stageError(StageValidate, fmt.Errorf("json: %w", err))
 	}
+	var err error
 	if evt.UploadID == "" || evt.UserID == "" || evt.RawVideoPath == "" {
-		return fmt.Errorf("missing required fields")
+		err = stageError(StageValidate, fmt.Errorf("missing required fields"))
+	} else {
+		err = t.process(ctx, &evt)
+	}
+	// A cancelled job (shutdown or reconnect) is redelivered, so it has not failed. Nor
+	// has one whose transcoded event failed to publish: the success marker is already
+	// written and the redelivery only republishes.
+	if err != nil && evt.UploadID != "" && ctx.Err() == nil && !failedAt(err, StagePublish) {
+		t.publishFailure(ctx, &evt, err)
+	}
+	return err
+}
+
+// process runs the pipeline for one upload. Errors are tagged with the failing stage.
+func (t *Transcoder) process(ctx context.Context, evt *UploadEvent) error {
+	j := &job{
+		evt:  evt,
+		work: filepath.Join(os.TempDir(), fmt.Sprintf("transcoder-%s", evt.UploadID)),
+		base: fmt.Sprintf("hls/%s/%s", evt.UserID, evt.UploadID),
+	}
+	if err := os.MkdirAll(j.work, 0o755); err != nil {
+		return err
+	}
+	defer os.RemoveAll(j.work)
+
+	// A forced run starts over once, on its first delivery; its retries resume from the
+	// state the forced run itself saved and republish if it already completed.
+	if attempt, _ := queue.DeliveryAttempt(ctx); evt.Force && attempt <= 1 {
+		if err := t.resetJob(ctx, evt, j.base); err != nil {
+			return stageError(StageUpload, fmt.Errorf("reset forced job: %w", err))
+		}
+	} else if done, err := t.republishIfDone(ctx, evt, j.base, j.work); done || err != nil {
+		return err
 	}
 
-	work := filepath.Join(os.TempDir(), fmt.Sprintf("transcoder-%s", evt.UploadID))
-	if err := os.MkdirAll(work, 0o755); err != nil {
+	ladder, err := t.selectLadder(j)
+	if err != nil {
 		return err
 	}
-	defer os.RemoveAll(work)
+	j.encodeMode = t.cfg.EncodeMode
+	if j.encodeMode == EncodeSinglePass && slices.ContainsFunc(ladder, ffmpeg.Rung.TwoPass) {
+		t.log.Infow("two-pass rungs, encoding per rendition", "uploadId", evt.UploadID)
+		j.encodeMode = EncodePerRendition
+	}
 
-	inputPath := filepath.Join(work, "input.mp4")
-	if err := t.az.DownloadTo(ctx, evt.RawVideoPath, inputPath); err != nil {
-		return fmt.Errorf("download: %w", err)
+	// Renditions finished by an earlier attempt are already uploaded.
+	j.state, err = t.states.Load(ctx, evt)
+	if err != nil {
+		return stageError(StageDownload, fmt.Errorf("job state: %w", err))
+	}
+
+	closeInput, err := t.openInput(ctx, j)
+	defer closeInput()
+	if err != nil {
+		return err
 	}
 
 	// Generate variants
-	outRoot := filepath.Join(work, "hls")
-	if err := os.MkdirAll(outRoot, 0o755); err != nil {
+	j.outRoot = filepath.Join(j.work, "hls")
+	if err := os.MkdirAll(j.outRoot, 0o755); err != nil {
+		return err
+	}
+
+	probe, err := ffmpeg.Probe(ctx, j.inputPath)
+	if err != nil {
+		return stageError(StageProbe, err)
+	}
+	j.probe = probe
+	if probe.Duration <= 0 {
+		// Neither the header nor the streams state a length; read the file to find it.
+		d, err := ffmpeg.MeasureDuration(ctx, j.inputPath)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			t.log.Warnw("measuring duration failed", "uploadId", evt.UploadID, "err", err)
+		}
+		probe.Duration = d
+		if probe.VideoDuration <= 0 {
+			probe.VideoDuration = d
+		}
+	}
+	t.log.Infow("probed input", "uploadId", evt.UploadID, "format", probe.FormatName, "width", probe.Width, "height", probe.Height,
+		"fps", probe.FrameRate, "duration", probe.Duration, "vcodec", probe.VideoCodec, "acodec", probe.AudioCodec,
+		"rotation", probe.Rotation)
+	if err := t.validateInput(probe); err != nil {
 		return err
 	}
 
-	ladder := evt.Resolutions
-	if len(ladder) == 0 {
-		ladder = []string{"1080p", "720p", "480p", "360p"}
+	// Never upscale: drop rungs taller than the source
+	ladder, dropped := ffmpeg.TrimLadder(ladder, probe)
+	if len(dropped) > 0 {
+		t.log.Infow("skipping renditions that would upscale", "uploadId", evt.UploadID, "dropped", rungNames(dropped))
+	}
+
+	var complexity *ffmpeg.Complexity
+	var pruned []ffmpeg.Rung
+	if j.perTitle {
+		if ladder, pruned, complexity, err = t.perTitle(ctx, j, ladder); err != nil {
+			return stageError(StageEncode, err)
+		}
 	}
 
-	for _, res := range ladder {
-		resDir := filepath.Join(outRoot, res)
-		if err := os.MkdirAll(resDir, 0o755); err != nil {
+	if j.dash && probe.AudioCodec != "" {
+		// DASH players expect audio in its own adaptation set, so it is encoded once at
+		// the best bitrate any rung asks for instead of into every variant.
+		for _, r := range ladder {
+			j.audioKbps = max(j.audioKbps, r.AudioBitrate)
+		}
+	}
+
+	var todo []ffmpeg.Rung
+	for _, r := range ladder {
+		if !j.state.Done(r.ID()) {
+			todo = append(todo, r)
+		}
+	}
+	audioTodo := j.audioKbps > 0 && !j.state.Done(ffmpeg.AudioRendition)
+	if len(todo) < len(ladder) || j.audioKbps > 0 && !audioTodo {
+		remaining := rungNames(todo)
+		if audioTodo {
+			remaining = append(remaining, ffmpeg.AudioRendition)
+		}
+		t.log.Infow("resuming job", "uploadId", evt.UploadID, "remaining", remaining)
+	}
+	if len(todo) > 0 || audioTodo {
+		if err := t.encode(ctx, j, todo, audioTodo, func(ctx context.Context, res string) error { return t.checkpoint(ctx, j, res) }); err != nil {
 			return err
 		}
+	}
 
-		cmd := ffmpeg.BuildHLSCommand(ctx, inputPath, resDir, res)
-		cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
-		start := time.Now()
-		if err := cmd.Run(); err != nil {
-			return fmt.Errorf("ffmpeg %s: %w", res, err)
+	if j.dash {
+		if err := t.writeDASH(ctx, j, ladder); err != nil {
+			return err
 		}
-		t.log.Infow("rendition done", "res", res, "ms", time.Since(start).Milliseconds())
 	}
 
-	// Write master playlist to outRoot
-	masterPath := filepath.Join(outRoot, "master.m3u8")
-	if err := os.WriteFile(masterPath, []byte(buildMaster(evt.UserID, evt.UploadID, ladder)), 0o644); err != nil {
+	// Master playlist goes up last so it never references a missing rendition.
+	masterPath := filepath.Join(j.outRoot, "master.m3u8")
+	if err := os.WriteFile(masterPath, []byte(buildMaster(j, ladder)), 0o644); err != nil {
 		return err
 	}
-
-	// Upload entire HLS folder (playlists + segments)
-	base := fmt.Sprintf("hls/%s/%s", evt.UserID, evt.UploadID)
-	if err := t.az.UploadDir(ctx, outRoot, base); err != nil {
-		return fmt.Errorf("upload hls: %w", err)
+	if err := t.store.UploadFile(ctx, masterPath, j.base+"/master.m3u8", "application/vnd.apple.mpegurl"); err != nil {
+		return stageError(StageUpload, fmt.Errorf("upload master: %w", err))
 	}
 
 	// Thumbnail
-	thumbPath := filepath.Join(work, "thumb.jpg")
-	thumbCmd := exec.CommandContext(ctx, "ffmpeg", "-y", "-ss", "1", "-i", inputPath, "-frames:v", "1", thumbPath)
+	thumbPath := filepath.Join(j.work, "thumb.jpg")
+	thumbCmd := exec.CommandContext(ctx, "ffmpeg", "-y", "-ss", "1", "-i", j.inputPath, "-frames:v", "1", thumbPath)
 	var thumbnailURL string
 	if err := thumbCmd.Run(); err == nil {
 		thumbBlobPath := fmt.Sprintf("thumbnails/%s/%s.jpg", evt.UserID, evt.UploadID)
-		if err := t.az.UploadFile(ctx, thumbPath, thumbBlobPath, "image/jpeg"); err == nil {
-			thumbnailURL = t.buildAzureURL(thumbBlobPath)
+		// The thumbnail is optional; the renditions are already uploaded.
+		if err := t.store.UploadFile(ctx, thumbPath, thumbBlobPath, "image/jpeg"); err != nil {
+			t.log.Warnw("thumbnail upload failed", "uploadId", evt.UploadID, "err", err)
+		} else {
+			thumbnailURL = t.store.PublicURL(thumbBlobPath)
 		}
 	}
 
@@ -156,30 +264,161 @@ func (t *Transcoder) Handle(ctx context.Context, body []byte) error {
 		"originalFilename": evt.OriginalName,
 		"rawVideoPath":     evt.RawVideoPath,
 		"hls": map[string]any{
-			"masterUrl": t.buildAzureURL(fmt.Sprintf("%s/%s", base, "master.m3u8")),
+			"masterUrl":   t.store.PublicURL(fmt.Sprintf("%s/%s", j.base, "master.m3u8")),
+			"segmentType": j.segType,
 		},
-		"thumbnailUrl": thumbnailURL,
-		"ready":        true,
+		"thumbnailUrl":      thumbnailURL,
+		"ladder":            ladderName(evt),
+		"renditions":        rungNames(ladder),
+		"droppedRenditions": rungNames(dropped),
+		"ready":             true,
+	}
+	if complexity != nil {
+		out["perTitle"] = perTitleEvent(complexity, ladder, pruned)
+	}
+	if j.dash {
+		out["dash"] = map[string]any{"manifestUrl": t.store.PublicURL(j.base + "/" + dashManifest)}
+	}
+	// Mark the job complete before publishing so a redelivery after a failed publish
+	// only has to republish.
+	if err := t.writeSuccessMarker(ctx, out, j.base, j.work); err != nil {
+		return stageError(StageUpload, fmt.Errorf("success marker: %w", err))
+	}
+	return stageError(StagePublish, t.pub.PublishJSON(ctx, out))
+}
+
+// checkpoint uploads a finished rendition under its final prefix and records it in the
+// job state, so a later attempt can skip it.
+func (t *Transcoder) checkpoint(ctx context.Context, j *job, res string) error {
+	dir := filepath.Join(j.outRoot, res)
+	variant, err := ffmpeg.MeasureVariant(ctx, dir)
+	if err != nil {
+		return stageError(StageEncode+":"+res, fmt.Errorf("measure %s: %w", res, err))
+	}
+	// A streamed source read that failed mid-way can end ffmpeg as if the input was complete.
+	if j.streamed && truncated(j.probe, res, variant.Duration) {
+		return stageError(StageEncode+":"+res, fmt.Errorf("%s is truncated: %.1fs encoded", res, variant.Duration))
+	}
+	start := time.Now()
+	stats, err := t.store.UploadDir(ctx, dir, j.base+"/"+res)
+	if err != nil {
+		return stageError(StageUpload, fmt.Errorf("upload %s: %w", res, err))
+	}
+	t.log.Infow("rendition uploaded", "uploadId", j.evt.UploadID, "res", res, "files", stats.Files, "bytes", stats.Bytes,
+		"ms", time.Since(start).Milliseconds())
+	j.saveMu.Lock()
+	defer j.saveMu.Unlock()
+	j.state.markDone(res, &RenditionState{CompletedAt: time.Now().UTC(), Variant: variant})
+	if err := t.states.Save(ctx, j.evt, j.state); err != nil {
+		// The rendition is safely uploaded; losing the checkpoint only costs a re-encode.
+		t.log.Warnw("job state save failed", "uploadId", j.evt.UploadID, "res", res, "err", err)
+	}
+	return nil
+}
+
+// truncated reports whether rendition res, encoded to the given length, falls clearly
+// short of the source stream it was made from: the audio stream for the separate audio
+// rendition, the video stream otherwise. Streams of unknown length are never truncated.
+func truncated(p *ffmpeg.ProbeResult, res string, encoded float64) bool {
+	source := p.VideoDuration
+	if res == ffmpeg.AudioRendition {
+		source = p.AudioDuration
+	}
+	if source <= 0 {
+		return false
+	}
+	return encoded < source-max(2, source*0.02)
+}
+
+// selectLadder resolves the event's named ladder and, when Resolutions is set, the subset
+// of its rungs to encode. It also settles the job's segment type. Unknown names are a
+// permanent failure.
+func (t *Transcoder) selectLadder(j *job) ([]ffmpeg.Rung, error) {
+	evt := j.evt
+	l, ok := t.cfg.Ladders[ladderName(evt)]
+	if !ok {
+		return nil, stageError(StageValidate, fmt.Errorf("unknown ladder %q", evt.Ladder))
+	}
+	switch {
+	case evt.SegmentType != "" && !ffmpeg.ValidSegmentType(evt.SegmentType):
+		return nil, stageError(StageValidate, fmt.Errorf("unknown segmentType %q", evt.SegmentType))
+	case evt.SegmentType != "":
+		j.segType = evt.SegmentType
+	case l.SegmentType != "":
+		j.segType = l.SegmentType
+	default:
+		j.segType = ffmpeg.SegmentMPEGTS
+	}
+	// DASH reuses the HLS segments and HEVC/VP9/AV1 are only delivered in fMP4.
+	if j.dash = evt.DASH || l.DASH; j.dash || l.HasExtraCodecs() {
+		if evt.SegmentType == ffmpeg.SegmentMPEGTS {
+			return nil, stageError(StageValidate, fmt.Errorf("ladder %q requires fmp4 segments", ladderName(evt)))
+		}
+		j.segType = ffmpeg.SegmentFMP4
+	}
+	j.perTitle = evt.PerTitle || l.PerTitle
+	if len(evt.Resolutions) == 0 {
+		return l.All(), nil
 	}
-	return t.pub.PublishJSON(ctx, out)
+	for _, res := range evt.Resolutions {
+		if _, ok := l.Rung(res); !ok {
+			return nil, stageError(StageValidate, fmt.Errorf("ladder %q has no rung %q", ladderName(evt), res))
+		}
+	}
+	// Resolutions name rungs of the H.264 ladder and pick the same rungs of other families.
+	var rungs []ffmpeg.Rung
+	for _, r := range l.All() {
+		if slices.Contains(evt.Resolutions, r.Name) {
+			rungs = append(rungs, r)
+		}
+	}
+	return rungs, nil
 }
 
-func buildMaster(userId, uploadId string, ladder []string) string {
-	// Bandwidth should match actual encoded bitrates (video + audio)
-	bw := map[string]int{
-		"1080p": 5192000, // 5000k video + 192k audio
-		"720p":  2928000, // 2800k video + 128k audio
-		"480p":  1496000, // 1400k video + 96k audio
-		"360p":  864000,  // 800k video + 64k audio
+func ladderName(evt *UploadEvent) string {
+	if evt.Ladder == "" {
+		return ffmpeg.DefaultLadderName
 	}
-	resMap := map[string]string{"1080p": "1920x1080", "720p": "1280x720", "480p": "854x480", "360p": "640x360"}
-	if len(ladder) == 0 {
-		ladder = []string{"1080p", "720p", "480p", "360p"}
+	return evt.Ladder
+}
+
+// buildMaster writes the HLS master playlist from the measured renditions. Renditions
+// checkpointed before measurements were recorded fall back to the rung's nominal values.
+// fMP4 media playlists use EXT-X-MAP, so the master declares version 7 to match them.
+func buildMaster(j *job, ladder []ffmpeg.Rung) string {
+	version := 3
+	if j.segType == ffmpeg.SegmentFMP4 {
+		version = 7
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "#EXTM3U\n#EXT-X-VERSION:%d\n#EXT-X-INDEPENDENT-SEGMENTS\n", version)
+	// A separate audio rendition is one audio group shared by every variant, whose
+	// bandwidth then has to include it.
+	var group string
+	audio := &ffmpeg.Variant{}
+	if j.audioKbps > 0 {
+		group = fmt.Sprintf(",AUDIO=\"%s\"", ffmpeg.AudioRendition)
+		if v := j.state.variant(ffmpeg.AudioRendition); v != nil {
+			audio = v
+		} else {
+			audio.Bandwidth, audio.AverageBandwidth = j.audioKbps*1000, j.audioKbps*1000
+		}
+		fmt.Fprintf(&b, "#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"%s\",NAME=\"default\",DEFAULT=YES,AUTOSELECT=YES,URI=\"%s/index.m3u8\"\n",
+			ffmpeg.AudioRendition, ffmpeg.AudioRendition)
 	}
-	s := "#EXTM3U\n"
 	for _, r := range ladder {
-		s += fmt.Sprintf("#EXT-X-STREAM-INF:BANDWIDTH=%d,RESOLUTION=%s\n", bw[r], resMap[r])
-		s += fmt.Sprintf("%s/index.m3u8\n", r)
+		v := j.state.variant(r.ID())
+		if v == nil {
+			fmt.Fprintf(&b, "#EXT-X-STREAM-INF:BANDWIDTH=%d,RESOLUTION=%s%s\n", r.Bandwidth(), r.Resolution(j.probe.Portrait()), group)
+		} else {
+			codecs := v.Codecs
+			if audio.Codecs != "" {
+				codecs += "," + audio.Codecs
+			}
+			fmt.Fprintf(&b, "#EXT-X-STREAM-INF:BANDWIDTH=%d,AVERAGE-BANDWIDTH=%d,RESOLUTION=%dx%d,FRAME-RATE=%.3f,CODECS=\"%s\"%s\n",
+				v.Bandwidth+audio.Bandwidth, v.AverageBandwidth+audio.AverageBandwidth, v.Width, v.Height, v.FrameRate, codecs, group)
+		}
+		fmt.Fprintf(&b, "%s/index.m3u8\n", r.ID())
 	}
-	return s
+	return b.String()
 }
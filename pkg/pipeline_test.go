@@ -0,0 +1,33 @@
+package pkg
+
+import (
+	"testing"
+
+	"github.com/streamhive/transcoder/internal/ffmpeg"
+)
+
+func TestTruncated(t *testing.T) {
+	tests := []struct {
+		name    string
+		probe   ffmpeg.ProbeResult
+		res     string
+		encoded float64
+		want    bool
+	}{
+		{"complete video", ffmpeg.ProbeResult{VideoDuration: 60, AudioDuration: 60}, "720p", 60, false},
+		{"video cut short", ffmpeg.ProbeResult{VideoDuration: 60, AudioDuration: 60}, "720p", 30, true},
+		{"audio runs longer than video", ffmpeg.ProbeResult{Duration: 75, VideoDuration: 60, AudioDuration: 75}, "720p", 60, false},
+		{"video runs longer than audio", ffmpeg.ProbeResult{Duration: 75, VideoDuration: 75, AudioDuration: 60}, ffmpeg.AudioRendition, 60, false},
+		{"audio cut short", ffmpeg.ProbeResult{VideoDuration: 60, AudioDuration: 60}, ffmpeg.AudioRendition, 20, true},
+		{"video start offset", ffmpeg.ProbeResult{Duration: 61.5, VideoDuration: 60, AudioDuration: 61.5}, "720p", 59.2, false},
+		{"unknown stream length", ffmpeg.ProbeResult{Duration: 60}, "720p", 10, false},
+		{"short clip within slack", ffmpeg.ProbeResult{VideoDuration: 3}, "360p", 1.5, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := truncated(&tt.probe, tt.res, tt.encoded); got != tt.want {
+				t.Fatalf("truncated(%s, %.1fs) = %v, want %v", tt.res, tt.encoded, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package pkg
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/streamhive/transcoder/internal/ffmpeg"
+	"github.com/streamhive/transcoder/internal/metrics"
+	"github.com/streamhive/transcoder/internal/queue"
+)
+
+// progressReporter folds per-process ffmpeg progress into one job percentage, updates the
+// worker gauge and publishes throttled progress events.
+type progressReporter struct {
+	t      *Transcoder
+	evt    *UploadEvent
+	worker string
+	total  int // number of ffmpeg processes contributing to the job
+
+	mu       sync.Mutex
+	parts    map[string]float64
+	lastSent time.Time
+}
+
+func (t *Transcoder) newProgressReporter(ctx context.Context, evt *UploadEvent, total int) *progressReporter {
+	r := &progressReporter{t: t, evt: evt, worker: queue.WorkerID(ctx), total: total, parts: map[string]float64{}}
+	if total < 1 {
+		r.total = 1
+	}
+	metrics.WorkerProgress.WithLabelValues(r.worker).Set(0)
+	return r
+}
+
+// resetProgress zeroes the worker's gauge, so an idle worker does not keep reporting the
+// last job's percentage.
+func resetProgress(ctx context.Context) {
+	metrics.WorkerProgress.WithLabelValues(queue.WorkerID(ctx)).Set(0)
+}
+
+// update records progress for one part (a rendition, or "ladder" in single-pass mode).
+func (r *progressReporter) update(ctx context.Context, part string, p ffmpeg.Progress) {
+	r.mu.Lock()
+	r.parts[part] = p.Percent
+	sum := 0.0
+	for _, v := range r.parts {
+		sum += v
+	}
+	percent := sum / float64(r.total)
+	metrics.WorkerProgress.WithLabelValues(r.worker).Set(percent)
+	if time.Since(r.lastSent) < r.t.cfg.ProgressInterval && !p.Done {
+		r.mu.Unlock()
+		return
+	}
+	r.lastSent = time.Now()
+	r.mu.Unlock()
+
+	evt := map[string]any{
+		"uploadId":   r.evt.UploadID,
+		"userId":     r.evt.UserID,
+		"rendition":  part,
+		"percent":    percent,
+		"outTimeSec": p.OutTime.Seconds(),
+		"fps":        p.FPS,
+		"speed":      p.Speed,
+	}
+	if err := r.t.pub.PublishJSONBestEffort(ctx, r.t.cfg.ProgressRoutingKey, evt); err != nil {
+		r.t.log.Warnw("progress publish failed", "uploadId", r.evt.UploadID, "err", err)
+	}
+}
+
+// runFFmpeg runs cmd, which must have been built with -progress pipe:1, and feeds the
+// parsed progress to the reporter under part.
+func (t *Transcoder) runFFmpeg(ctx context.Context, cmd *exec.Cmd, rep *progressReporter, part string, duration float64) error {
+	tail := ffmpeg.NewTailBuffer(stderrTailBytes)
+	cmd.Stderr = io.MultiWriter(os.Stderr, tail)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = ffmpeg.ParseProgress(stdout, duration, func(p ffmpeg.Progress) { rep.update(ctx, part, p) })
+	}()
+	// Wait closes stdout, so the parser must drain it first.
+	<-done
+	if err := cmd.Wait(); err != nil {
+		return &ffmpeg.CommandError{Err: err, Stderr: tail.String()}
+	}
+	return nil
+}
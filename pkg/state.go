@@ -0,0 +1,203 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/streamhive/transcoder/internal/ffmpeg"
+	"github.com/streamhive/transcoder/internal/storage"
+)
+
+// JobState records which renditions of an upload are already encoded and uploaded under
+// the final prefix, so a redelivered job only redoes the missing ones.
+type JobState struct {
+	UploadID   string                     `json:"uploadId"`
+	Renditions map[string]*RenditionState `json:"renditions"`
+	// Complexity is the per-title analysis result, reused on retries so resumed renditions
+	// and new ones come from the same ladder.
+	Complexity *ffmpeg.Complexity `json:"complexity,omitempty"`
+
+	mu sync.Mutex
+}
+
+// RenditionState describes one finished rendition. Variant keeps the measured playlist
+// attributes so a resumed job can write the master playlist without the local outputs.
+type RenditionState struct {
+	CompletedAt time.Time       `json:"completedAt"`
+	Variant     *ffmpeg.Variant `json:"variant,omitempty"`
+}
+
+// Done reports whether res was finished by this or a previous attempt.
+func (s *JobState) Done(res string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.Renditions[res]
+	return ok
+}
+
+// variant returns the measured attributes of res, or nil when they are unknown.
+func (s *JobState) variant(res string) *ffmpeg.Variant {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if rs := s.Renditions[res]; rs != nil {
+		return rs.Variant
+	}
+	return nil
+}
+
+func (s *JobState) complexity() *ffmpeg.Complexity {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Complexity
+}
+
+func (s *JobState) setComplexity(c *ffmpeg.Complexity) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Complexity = c
+}
+
+// markDone records res as finished.
+func (s *JobState) markDone(res string, rs *RenditionState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Renditions[res] = rs
+}
+
+func (s *JobState) marshal() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return json.Marshal(s)
+}
+
+func newJobState(uploadID string) *JobState {
+	return &JobState{UploadID: uploadID, Renditions: map[string]*RenditionState{}}
+}
+
+// JobStateStore persists JobState between attempts of the same upload.
+type JobStateStore interface {
+	// Load returns the saved state for evt, or an empty state when none exists.
+	Load(ctx context.Context, evt *UploadEvent) (*JobState, error)
+	Save(ctx context.Context, evt *UploadEvent, s *JobState) error
+	// Clear removes the saved state for evt, if any.
+	Clear(ctx context.Context, evt *UploadEvent) error
+}
+
+// NewJobStateStoreFromEnv picks the store from TRANSCODER_STATE_STORE: "blob" (default)
+// keeps state next to the HLS outputs, "local" keeps it under TRANSCODER_STATE_DIR.
+func NewJobStateStoreFromEnv(store storage.Backend) JobStateStore {
+	if getenv("TRANSCODER_STATE_STORE", "blob") == "local" {
+		return &fileStateStore{dir: getenv("TRANSCODER_STATE_DIR", filepath.Join(os.TempDir(), "transcoder-state"))}
+	}
+	return &blobStateStore{store: store}
+}
+
+// blobStateStore keeps state in hls/<user>/<upload>/_state.json.
+type blobStateStore struct {
+	store storage.Backend
+}
+
+func (b *blobStateStore) blobPath(evt *UploadEvent) string {
+	return fmt.Sprintf("hls/%s/%s/_state.json", evt.UserID, evt.UploadID)
+}
+
+func (b *blobStateStore) Load(ctx context.Context, evt *UploadEvent) (*JobState, error) {
+	exists, err := b.store.BlobExists(ctx, b.blobPath(evt))
+	if err != nil || !exists {
+		return newJobState(evt.UploadID), err
+	}
+	f, err := os.CreateTemp("", "transcoder-state-*.json")
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	if err := b.store.DownloadTo(ctx, b.blobPath(evt), f.Name()); err != nil {
+		return nil, err
+	}
+	return readStateFile(f.Name(), evt.UploadID)
+}
+
+func (b *blobStateStore) Save(ctx context.Context, evt *UploadEvent, s *JobState) error {
+	data, err := s.marshal()
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp("", "transcoder-state-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return b.store.UploadFile(ctx, f.Name(), b.blobPath(evt), "application/json")
+}
+
+func (b *blobStateStore) Clear(ctx context.Context, evt *UploadEvent) error {
+	return b.store.DeleteBlobsWithPrefix(ctx, b.blobPath(evt))
+}
+
+// fileStateStore keeps state on a local (ideally persistent) volume.
+type fileStateStore struct {
+	dir string
+}
+
+func (f *fileStateStore) path(evt *UploadEvent) string {
+	return filepath.Join(f.dir, evt.UploadID+".json")
+}
+
+func (f *fileStateStore) Load(ctx context.Context, evt *UploadEvent) (*JobState, error) {
+	s, err := readStateFile(f.path(evt), evt.UploadID)
+	if os.IsNotExist(err) {
+		return newJobState(evt.UploadID), nil
+	}
+	return s, err
+}
+
+func (f *fileStateStore) Save(ctx context.Context, evt *UploadEvent, s *JobState) error {
+	data, err := s.marshal()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(f.dir, 0o755); err != nil {
+		return err
+	}
+	// Write then rename so a crash never leaves a truncated state file.
+	tmp := f.path(evt) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.path(evt))
+}
+
+func (f *fileStateStore) Clear(ctx context.Context, evt *UploadEvent) error {
+	if err := os.Remove(f.path(evt)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func readStateFile(path, uploadID string) (*JobState, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s := newJobState(uploadID)
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, fmt.Errorf("job state: %w", err)
+	}
+	if s.Renditions == nil {
+		s.Renditions = map[string]*RenditionState{}
+	}
+	return s, nil
+}
@@ -0,0 +1,65 @@
+package pkg
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/streamhive/transcoder/internal/ffmpeg"
+)
+
+var safeExt = regexp.MustCompile(`^\.[a-z0-9]{1,8}$`)
+
+// inputExt picks the extension the source is saved under, preferring the blob name over
+// the user supplied file name. ffmpeg uses it as a format hint.
+func inputExt(evt *UploadEvent) string {
+	for _, name := range []string{evt.RawVideoPath, evt.OriginalName} {
+		if ext := strings.ToLower(path.Ext(name)); safeExt.MatchString(ext) {
+			return ext
+		}
+	}
+	return ".mp4"
+}
+
+// validateInput rejects sources the pipeline cannot or should not encode, before any
+// ffmpeg time is spent on them. Rejections are permanent.
+func (t *Transcoder) validateInput(p *ffmpeg.ProbeResult) error {
+	reject := func(class string, format string, args ...any) error {
+		return &JobError{Stage: StageProbe, Class: class, Err: fmt.Errorf(format, args...)}
+	}
+	if p.VideoCodec == "" || p.Width == 0 || p.Height == 0 {
+		return reject(ClassCorruptInput, "%w", ffmpeg.ErrNoVideoStream)
+	}
+	if p.Duration <= 0 {
+		return reject(ClassCorruptInput, "could not determine duration")
+	}
+	if t.cfg.MinDuration > 0 && p.Duration < t.cfg.MinDuration {
+		return reject(ClassInvalidInput, "duration %.1fs is shorter than the %.1fs minimum", p.Duration, t.cfg.MinDuration)
+	}
+	if t.cfg.MaxDuration > 0 && p.Duration > t.cfg.MaxDuration {
+		return reject(ClassInvalidInput, "duration %.0fs exceeds the %.0fs limit", p.Duration, t.cfg.MaxDuration)
+	}
+	if !anyAllowed(strings.Split(p.FormatName, ","), t.cfg.AllowedContainers) {
+		return reject(ClassInvalidInput, "container %q is not allowed", p.FormatName)
+	}
+	if !anyAllowed([]string{p.VideoCodec}, t.cfg.AllowedVideoCodecs) {
+		return reject(ClassUnsupportedCodec, "video codec %q is not supported", p.VideoCodec)
+	}
+	return nil
+}
+
+// anyAllowed reports whether one of names is in allowed. An empty allow list allows all.
+func anyAllowed(names, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, n := range names {
+		for _, a := range allowed {
+			if strings.EqualFold(strings.TrimSpace(n), a) {
+				return true
+			}
+		}
+	}
+	return false
+}